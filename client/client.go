@@ -0,0 +1,379 @@
+// Package client is a Go client for the NCBI data tool server. It wraps
+// the file and directory routes in typed methods, retries transient
+// failures with backoff and can download resolved versions to disk.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"ncbi-tool-server/models"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLayout is the format of points in time sent to the server, which
+// reads them as UTC
+const TimeLayout = "2006-01-02T15:04:05"
+
+// Formats a point in time for the server.
+func formatTime(at time.Time) string {
+	return at.UTC().Format(TimeLayout)
+}
+
+// Client calls the server at BaseURL. The zero values of the other fields
+// are usable, except that Retries of zero disables retrying.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Token is sent as a bearer token, if set
+	Token string
+	// Retries is how many times a request is retried after a network
+	// error or a 429, 502, 503 or 504 response
+	Retries int
+	// Backoff is the wait before the first retry. It doubles for each
+	// later retry, with jitter.
+	Backoff time.Duration
+}
+
+// New returns a client for the server at baseURL, like
+// "https://ncbi-tool.example.org", with default retry settings
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: http.DefaultClient,
+		Retries:    3,
+		Backoff:    200 * time.Millisecond,
+	}
+}
+
+// Error is an error response from the server. Code is the HTTP status and
+// ErrorCode a stable identifier for the problem, like "file_not_found".
+type Error struct {
+	Code      int
+	ErrorCode string
+	Message   string `json:"Error"`
+	// Size is the object size a 416 response reported, or -1
+	Size int64 `json:"-"`
+}
+
+// Error formats the status and message
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.ErrorCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server
+func IsNotFound(err error) bool {
+	var res *Error
+	return errors.As(err, &res) && res.Code == http.StatusNotFound
+}
+
+// GetFile gets a version of a file. A version of zero gets the latest.
+func (c *Client) GetFile(ctx context.Context, path string,
+	version int) (models.Entry, error) {
+	res := models.Entry{}
+	query := url.Values{"path-name": {path}}
+	if version > 0 {
+		query.Set("version-num", strconv.Itoa(version))
+	}
+	err := c.getJSON(ctx, "/file", query, &res)
+	return res, err
+}
+
+// GetFileAtTime gets the version of a file at a point in time
+func (c *Client) GetFileAtTime(ctx context.Context, path string,
+	at time.Time) (models.Entry, error) {
+	res := models.Entry{}
+	query := url.Values{"path-name": {path},
+		"input-time": {formatTime(at)}}
+	err := c.getJSON(ctx, "/file/at-time", query, &res)
+	return res, err
+}
+
+// History lists the versions of a file, newest first
+func (c *Client) History(ctx context.Context,
+	path string) ([]models.Entry, error) {
+	res := []models.Entry{}
+	query := url.Values{"path-name": {path}}
+	err := c.getJSON(ctx, "/file/history", query, &res)
+	return res, err
+}
+
+// ListDirectory lists a directory at a point in time, or as it is now if
+// at is zero. Entries include download URLs if withURLs is set.
+func (c *Client) ListDirectory(ctx context.Context, path string,
+	at time.Time, withURLs bool) ([]models.Entry, error) {
+	res := []models.Entry{}
+	route := "/directory"
+	query := url.Values{"path-name": {path}}
+	if !at.IsZero() {
+		route = "/directory/at-time"
+		query.Set("input-time", formatTime(at))
+	}
+	if withURLs {
+		query.Set("output", "with-URLs")
+	}
+	err := c.getJSON(ctx, route, query, &res)
+	return res, err
+}
+
+// CompareDirectory compares a directory between two points in time. Each
+// file present at end is tagged Added, Updated or Unchanged.
+func (c *Client) CompareDirectory(ctx context.Context, path string,
+	start time.Time, end time.Time) ([]models.CompareResponse, error) {
+	res := []models.CompareResponse{}
+	query := url.Values{"path-name": {path},
+		"start-date": {formatTime(start)},
+		"end-date":   {formatTime(end)}}
+	err := c.getJSON(ctx, "/directory/compare", query, &res)
+	return res, err
+}
+
+// What a .part file is a download of. It's kept next to the .part file,
+// so that a download only resumes a .part file of the same version and
+// object.
+type partInfo struct {
+	Path    string
+	Version int
+	ETag    string
+}
+
+// Download saves the file version an entry resolved to at dest. The data
+// is written to dest+".part" and renamed into place only once its size
+// matches what the object store reported, so dest is never left partial.
+// If a .part file is left from an interrupted download of the same
+// version, the download resumes from where it stopped, as long as the
+// object's ETag is unchanged. Other .part files are started over. Returns
+// the size of the file.
+func (c *Client) Download(ctx context.Context, entry models.Entry,
+	dest string) (int64, error) {
+	if entry.URL == "" {
+		return 0, errors.New("Entry for " + entry.Path +
+			" has no URL. Resolve it with a URL first.")
+	}
+	part := dest + ".part"
+	info := partInfo{Path: entry.Path, Version: entry.Version}
+	saved := readPartInfo(part + ".info")
+	out, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 && (saved.Path != info.Path ||
+		saved.Version != info.Version || saved.ETag == "") {
+		// Not known to be from this version
+		if err = out.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err = out.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		offset = 0
+	}
+
+	// The URL is presigned, so it doesn't take the API token. If-Range
+	// makes the store send the whole object if it changed.
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		header.Set("If-Range", saved.ETag)
+	}
+	resp, err := c.do(ctx, entry.URL, false, header)
+	var apiErr *Error
+	if errors.As(err, &apiErr) &&
+		apiErr.Code == http.StatusRequestedRangeNotSatisfiable {
+		// The object is unchanged, so the .part file is complete unless
+		// it's somehow longer than the object
+		if apiErr.Size == offset {
+			return offset, finishDownload(out, part, dest)
+		}
+		if err = out.Truncate(0); err != nil {
+			return 0, err
+		}
+		offset = 0
+		resp, err = c.do(ctx, entry.URL, false, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	size := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		size = contentRangeSize(resp.Header.Get("Content-Range"))
+	} else if offset > 0 {
+		// The store sent the whole file
+		if err = out.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err = out.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		offset = 0
+	}
+	if offset == 0 {
+		// Weak ETags can't be used with If-Range
+		info.ETag = resp.Header.Get("ETag")
+		if strings.HasPrefix(info.ETag, "W/") {
+			info.ETag = ""
+		}
+		if err = writePartInfo(part+".info", info); err != nil {
+			return 0, err
+		}
+	}
+	written, err := io.Copy(out, resp.Body)
+	total := offset + written
+	if err != nil {
+		return total, err
+	}
+	if size >= 0 && total != size {
+		return total, fmt.Errorf("Downloaded %d bytes of %s but "+
+			"expected %d.", total, entry.Path, size)
+	}
+	return total, finishDownload(out, part, dest)
+}
+
+// Closes a complete download and moves it into place.
+func finishDownload(out *os.File, part string, dest string) error {
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return err
+	}
+	err := os.Remove(part + ".info")
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// Reads what a .part file is a download of. Returns the zero value if it
+// isn't known.
+func readPartInfo(name string) partInfo {
+	res := partInfo{}
+	if data, err := os.ReadFile(name); err == nil {
+		json.Unmarshal(data, &res)
+	}
+	return res
+}
+
+// Records what a .part file is a download of.
+func writePartInfo(name string, info partInfo) error {
+	data, _ := json.Marshal(info)
+	return os.WriteFile(name, data, 0644)
+}
+
+// Gets the full object size from a Content-Range header like
+// "bytes 100-199/200" or "bytes */200". Returns -1 if it's unknown.
+func contentRangeSize(header string) int64 {
+	slash := strings.LastIndex(header, "/")
+	if slash < 0 {
+		return -1
+	}
+	res, err := strconv.ParseInt(header[slash+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return res
+}
+
+// Calls a route and decodes its JSON response into res.
+func (c *Client) getJSON(ctx context.Context, route string,
+	query url.Values, res interface{}) error {
+	resp, err := c.do(ctx, c.BaseURL+route+"?"+query.Encode(), true, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return fmt.Errorf("Couldn't decode response from %s: %w", route, err)
+	}
+	return nil
+}
+
+// Makes a GET request with the given extra headers, retrying transient
+// failures. Responses other than 200 and 206 are returned as an *Error.
+func (c *Client) do(ctx context.Context, target string, auth bool,
+	header http.Header) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	wait := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if auth && c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := httpClient.Do(req)
+		if err == nil && (resp.StatusCode == http.StatusOK ||
+			resp.StatusCode == http.StatusPartialContent) {
+			return resp, nil
+		}
+		if err == nil {
+			err = responseError(resp)
+		}
+		if attempt >= c.Retries || !retryable(err) {
+			return nil, err
+		}
+
+		// Wait between half and all of the backoff
+		delay := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// Reads an error response and closes its body.
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	res := &Error{}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil || json.Unmarshal(body, res) != nil || res.Code == 0 {
+		// Not from the server, e.g. a proxy or the object store
+		res = &Error{Message: string(body)}
+	}
+	res.Code = resp.StatusCode
+	res.Size = contentRangeSize(resp.Header.Get("Content-Range"))
+	return res
+}
+
+// Whether a failed request is worth retrying.
+func retryable(err error) bool {
+	var res *Error
+	if !errors.As(err, &res) {
+		// Network errors, unless the caller gave up
+		return !errors.Is(err, context.Canceled) &&
+			!errors.Is(err, context.DeadlineExceeded)
+	}
+	switch res.Code {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"ncbi-tool-server/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetriesAndAuth(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			assert.Equal(t, "Bearer abc123", r.Header.Get("Authorization"))
+			assert.Equal(t, "/blast/db/README", r.URL.Query().Get("path-name"))
+			assert.Equal(t, "2017-06-01T00:00:00",
+				r.URL.Query().Get("input-time"))
+			if calls == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"Code": 503, "ErrorCode": ` +
+					`"database_unavailable", "Error": "Error: down"}`))
+				return
+			}
+			w.Write([]byte(`{"Path": "/blast/db/README", "Version": 2}`))
+		}))
+	defer server.Close()
+	c := New(server.URL)
+	c.Token = "abc123"
+	c.Backoff = time.Millisecond
+
+	entry, err := c.GetFileAtTime(context.Background(), "/blast/db/README",
+		time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, entry.Version)
+	assert.Equal(t, 2, calls)
+}
+
+func TestTimesSentAsUTC(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "2017-06-01T10:00:00",
+				r.URL.Query().Get("input-time"))
+			w.Write([]byte(`{"Path": "/blast/db/README", "Version": 2}`))
+		}))
+	defer server.Close()
+
+	at := time.Date(2017, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 7200))
+	_, err := New(server.URL).GetFileAtTime(context.Background(),
+		"/blast/db/README", at)
+	assert.Nil(t, err)
+}
+
+func TestNotFound(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"Code": 404, "ErrorCode": "file_not_found", ` +
+				`"Error": "Error: No results for this query."}`))
+		}))
+	defer server.Close()
+
+	_, err := New(server.URL).History(context.Background(), "/nope")
+	assert.True(t, IsNotFound(err))
+	assert.Equal(t, "file_not_found", err.(*Error).ErrorCode)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "", r.Header.Get("Authorization"))
+			w.Write([]byte("hello"))
+		}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	c := New(server.URL)
+	c.Token = "abc123"
+
+	dest := filepath.Join(dir, "README")
+	n, err := c.Download(context.Background(),
+		models.Entry{Path: "/blast/db/README", URL: server.URL}, dest)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+	data, err := ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestDownloadResumes(t *testing.T) {
+	content := "hello world"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"`+content+`"`)
+			http.ServeContent(w, r, "README", time.Time{},
+				strings.NewReader(content))
+		}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "README")
+	entry := models.Entry{Path: "/blast/db/README", Version: 2,
+		URL: server.URL}
+	download := func(part string, info partInfo) string {
+		assert.Nil(t, ioutil.WriteFile(dest+".part", []byte(part), 0644))
+		assert.Nil(t, writePartInfo(dest+".part.info", info))
+		n, err := New(server.URL).Download(context.Background(), entry,
+			dest)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		for _, name := range []string{dest + ".part", dest + ".part.info"} {
+			_, err = os.Stat(name)
+			assert.True(t, os.IsNotExist(err))
+		}
+		data, err := ioutil.ReadFile(dest)
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	assert.Equal(t, "hello world", download("hello",
+		partInfo{"/blast/db/README", 2, `"hello world"`}))
+	// A .part file of another version is started over, even if it's as
+	// long as this one
+	assert.Equal(t, "hello world", download("HELLO WORLD",
+		partInfo{"/blast/db/README", 1, `"HELLO WORLD"`}))
+	// So is one whose object changed since
+	content = "hello again"
+	assert.Equal(t, "hello again", download("hello",
+		partInfo{"/blast/db/README", 2, `"hello world"`}))
+}
@@ -0,0 +1,78 @@
+// Command ncbi-audit checks that every entry has its object in the bucket
+// and every archived object has its entry, like the server's scheduled
+// audit. It takes the server's flags and environment, saves the report
+// with the server's, and prints it as JSON. It exits with status 1 if the
+// audit found problems and 2 if it failed.
+//
+// Usage:
+//
+//	ncbi-audit [server flags] [--verify]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"log/slog"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"os"
+	"os/signal"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// Runs the audit and gets the exit status.
+func run(osArgs []string) int {
+	args := []string{}
+	verify := false
+	for _, arg := range osArgs {
+		if arg == "--verify" || arg == "-verify" {
+			verify = true
+			continue
+		}
+		args = append(args, arg)
+	}
+	conf, err := utils.LoadConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ncbi-audit: "+err.Error())
+		return 2
+	}
+	logger := utils.NewLogger(conf.Log, os.Stderr)
+	slog.SetDefault(logger)
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ctx := utils.NewContext()
+	ctx.Config = conf
+	ctx.Log = logger
+	ctx.Bucket = conf.Bucket
+	ctx.RequestCtx = runCtx
+	ctx.Store = utils.TracedStore{
+		S3API: s3.New(session.Must(session.NewSession())),
+	}
+	ctx.SetupDatabase()
+	defer ctx.Db.Close()
+	if err = models.SetupTables(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "ncbi-audit: "+err.Error())
+		return 2
+	}
+
+	report, err := models.NewAudit(ctx).Run(verify || conf.Audit.Verify)
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	switch {
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "ncbi-audit: "+err.Error())
+		return 2
+	case report.Missing+report.Orphaned+report.Mismatched > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"ncbi-tool-server/models"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// syncManifest records the version of each file a sync downloaded, so
+// later syncs skip files that haven't changed
+const syncManifest = ".ncbi-tool-sync.json"
+
+func init() {
+	var at string
+	commands["ls"] = &command{
+		usage: "ls <path> [--at T]",
+		args:  1,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&at, "at", "", "list the directory as it was at T")
+		},
+		run: func(ctx context.Context, t *tool, args []string) error {
+			when, err := optionalTime(at)
+			if err != nil {
+				return err
+			}
+			res, err := t.client.ListDirectory(ctx, args[0], when, false)
+			if err != nil {
+				return err
+			}
+			return t.printEntries(res)
+		},
+	}
+
+	commands["history"] = &command{
+		usage: "history <file>",
+		args:  1,
+		run: func(ctx context.Context, t *tool, args []string) error {
+			res, err := t.client.History(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			return t.printEntries(res)
+		},
+	}
+
+	commands["diff-dir"] = &command{
+		usage: "diff-dir <path> <t1> <t2>",
+		args:  3,
+		run: func(ctx context.Context, t *tool, args []string) error {
+			start, err := parseTime(args[1])
+			if err != nil {
+				return err
+			}
+			end, err := parseTime(args[2])
+			if err != nil {
+				return err
+			}
+			res, err := t.client.CompareDirectory(ctx, args[0], start, end)
+			if err != nil {
+				return err
+			}
+			if t.json {
+				return t.printJSON(res)
+			}
+			rows := [][]string{}
+			for _, val := range res {
+				rows = append(rows, val.Row())
+			}
+			return t.printTable(rows)
+		},
+	}
+
+	var version int
+	var getAt, output string
+	commands["get"] = &command{
+		usage: "get <file> [--version N | --at T] [-o out]",
+		args:  1,
+		flags: func(fs *flag.FlagSet) {
+			fs.IntVar(&version, "version", 0, "version to get, default latest")
+			fs.StringVar(&getAt, "at", "", "get the version current at T")
+			fs.StringVar(&output, "o", "", "file to write, default the name")
+		},
+		run: func(ctx context.Context, t *tool, args []string) error {
+			if version > 0 && getAt != "" {
+				return errors.New("Give --version or --at, not both.")
+			}
+			var entry models.Entry
+			var err error
+			if getAt != "" {
+				var when time.Time
+				if when, err = parseTime(getAt); err != nil {
+					return err
+				}
+				entry, err = t.client.GetFileAtTime(ctx, args[0], when)
+			} else {
+				entry, err = t.client.GetFile(ctx, args[0], version)
+			}
+			if err != nil {
+				return err
+			}
+			dest := output
+			if dest == "" {
+				dest = path.Base(entry.Path)
+			}
+			size, err := t.client.Download(ctx, entry, dest)
+			if err != nil {
+				return err
+			}
+			if t.json {
+				return t.printJSON(entry)
+			}
+			_, err = fmt.Fprintf(t.out, "%s version %d -> %s (%d bytes)\n",
+				entry.Path, entry.Version, dest, size)
+			return err
+		},
+	}
+
+	var syncAt string
+	commands["sync"] = &command{
+		usage: "sync <dir> --at T <localdir>",
+		args:  2,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&syncAt, "at", "", "sync the directory as it was at T")
+		},
+		run: func(ctx context.Context, t *tool, args []string) error {
+			if syncAt == "" {
+				return errors.New("sync needs --at.")
+			}
+			when, err := parseTime(syncAt)
+			if err != nil {
+				return err
+			}
+			return t.sync(ctx, args[0], when, args[1])
+		},
+	}
+}
+
+// Returns the zero time for an empty value, or the parsed time.
+func optionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return parseTime(value)
+}
+
+// Downloads each file in a directory at a point in time into localDir.
+// Files the manifest says are already at the right version are skipped,
+// and interrupted downloads resume.
+func (t *tool) sync(ctx context.Context, dir string, when time.Time,
+	localDir string) error {
+	listing, err := t.client.ListDirectory(ctx, dir, when, true)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(localDir, 0755); err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(localDir, syncManifest)
+	manifest := map[string]int{}
+	data, err := ioutil.ReadFile(manifestPath)
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Couldn't read %s: %w", manifestPath, err)
+	}
+
+	synced := []models.Entry{}
+	for _, entry := range listing {
+		name := path.Base(entry.Path)
+		dest := filepath.Join(localDir, name)
+		if _, statErr := os.Stat(dest); statErr == nil &&
+			manifest[name] == entry.Version {
+			continue
+		}
+		size, err := t.client.Download(ctx, entry, dest)
+		if err != nil {
+			return fmt.Errorf("Couldn't download %s: %w", entry.Path, err)
+		}
+		manifest[name] = entry.Version
+		if err = writeManifest(manifestPath, manifest); err != nil {
+			return err
+		}
+		entry.URL = ""
+		synced = append(synced, entry)
+		if !t.json {
+			fmt.Fprintf(t.out, "%s version %d -> %s (%d bytes)\n",
+				entry.Path, entry.Version, dest, size)
+		}
+	}
+	if t.json {
+		return t.printJSON(synced)
+	}
+	_, err = fmt.Fprintf(t.out, "%d of %d files downloaded.\n",
+		len(synced), len(listing))
+	return err
+}
+
+// Saves the sync manifest.
+func writeManifest(name string, manifest map[string]int) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+// Prints entries as JSON or as a table without URLs.
+func (t *tool) printEntries(entries []models.Entry) error {
+	if t.json {
+		return t.printJSON(entries)
+	}
+	rows := [][]string{}
+	for _, entry := range entries {
+		row := entry.Row()
+		rows = append(rows, row[:len(row)-1])
+	}
+	return t.printTable(rows)
+}
+
+// Prints a value as indented JSON.
+func (t *tool) printJSON(value interface{}) error {
+	enc := json.NewEncoder(t.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(value)
+}
+
+// Prints rows as aligned columns.
+func (t *tool) printTable(rows [][]string) error {
+	writer := tabwriter.NewWriter(t.out, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,135 @@
+// Command ncbi-tool browses and fetches past versions of the NCBI data
+// mirrored by the server.
+//
+// Usage:
+//
+//	ncbi-tool ls <path> [--at T]
+//	ncbi-tool history <file>
+//	ncbi-tool diff-dir <path> <t1> <t2>
+//	ncbi-tool get <file> [--version N | --at T] [-o out]
+//	ncbi-tool sync <dir> --at T <localdir>
+//
+// Times are dates like 2017-06-01 or times like 2017-06-01T12:00:00. Every
+// command takes --json for JSON output instead of a table, and --server
+// and --token, which default to $NCBI_TOOL_SERVER and $NCBI_TOOL_TOKEN.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"ncbi-tool-server/client"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// A subcommand. Run gets the positional arguments after the flags have
+// been parsed.
+type command struct {
+	usage string
+	args  int
+	flags func(fs *flag.FlagSet)
+	run   func(ctx context.Context, t *tool, args []string) error
+}
+
+var commands = map[string]*command{}
+
+// Shared state for running a command
+type tool struct {
+	client *client.Client
+	json   bool
+	out    io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ncbi-tool: "+err.Error())
+		stop()
+		os.Exit(1)
+	}
+}
+
+// Runs the command named by the first argument.
+func run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return usageError()
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return usageError()
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	server := fs.String("server", os.Getenv("NCBI_TOOL_SERVER"),
+		"server URL")
+	token := fs.String("token", os.Getenv("NCBI_TOOL_TOKEN"), "API token")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	pos, err := parseInterspersed(fs, args[1:])
+	if err != nil {
+		return fmt.Errorf("%s. Usage: ncbi-tool %s", err, cmd.usage)
+	}
+	if len(pos) != cmd.args {
+		return fmt.Errorf("Usage: ncbi-tool %s", cmd.usage)
+	}
+	if *server == "" {
+		return errors.New("No server. Set --server or NCBI_TOOL_SERVER.")
+	}
+	c := client.New(*server)
+	c.Token = *token
+	return cmd.run(ctx, &tool{client: c, json: *asJSON, out: out}, pos)
+}
+
+// Parses flags that may come before, between or after the positional
+// arguments, which the flag package alone doesn't allow. Returns the
+// positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	res := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return res, nil
+		}
+		res = append(res, args[0])
+		args = args[1:]
+	}
+}
+
+// Lists the commands.
+func usageError() error {
+	msg := "Usage:"
+	for _, name := range []string{"ls", "history", "diff-dir", "get",
+		"sync"} {
+		msg += "\n  ncbi-tool " + commands[name].usage
+	}
+	return errors.New(msg)
+}
+
+// Time layouts accepted on the command line
+var timeLayouts = []string{
+	client.TimeLayout,
+	"2006-01-02T15:04",
+	"2006-01-02",
+	time.RFC3339,
+}
+
+// Parses a point in time given on the command line.
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if res, err := time.Parse(layout, value); err == nil {
+			return res, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q. Use a date like "+
+		"2017-06-01 or a time like 2017-06-01T12:00:00.", value)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	at := fs.String("at", "", "")
+	args, err := parseInterspersed(fs, []string{"/blast/db", "--at",
+		"2017-06-01", "extra"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/blast/db", "extra"}, args)
+	assert.Equal(t, "2017-06-01", *at)
+}
+
+func TestParseTime(t *testing.T) {
+	res, err := parseTime("2017-06-01")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), res)
+	_, err = parseTime("June")
+	assert.NotNil(t, err)
+}
+
+func TestLs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/directory/at-time", r.URL.Path)
+			assert.Equal(t, "2017-06-01T00:00:00",
+				r.URL.Query().Get("input-time"))
+			w.Write([]byte(`[{"Path": "/blast/db/README", "Version": 2, ` +
+				`"ModTime": "2017-05-01T00:00:00"}]`))
+		}))
+	defer server.Close()
+
+	out := &bytes.Buffer{}
+	err := run(context.Background(), []string{"ls", "/blast/db",
+		"--at", "2017-06-01", "--server", server.URL}, out)
+	assert.Nil(t, err)
+	assert.Equal(t, "2  2017-05-01T00:00:00  /blast/db/README\n", out.String())
+}
@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminController is for handling maintenance actions. Only the
+// configured admins may use it.
+type AdminController struct {
+	ApplicationController
+	ctx *utils.Context
+}
+
+// NewAdminController returns a new controller instance
+func NewAdminController(ctx *utils.Context) *AdminController {
+	return &AdminController{
+		ctx: ctx,
+	}
+}
+
+// Register registers the admin endpoints with the router
+func (adc *AdminController) Register(router *mux.Router) {
+	router.HandleFunc("/admin/gc", adc.adminOnly(adc.GC)).
+		Methods(http.MethodPost)
+	router.HandleFunc("/admin/deletions", adc.adminOnly(adc.Deletions))
+	router.HandleFunc("/admin/audit", adc.adminOnly(adc.StartAudit)).
+		Methods(http.MethodPost)
+	router.HandleFunc("/admin/audit", adc.adminOnly(adc.ShowAudit)).
+		Methods(http.MethodGet)
+	router.HandleFunc("/admin/yank", adc.adminOnly(adc.Yank)).
+		Methods(http.MethodPost)
+	router.HandleFunc("/admin/yank", adc.adminOnly(adc.Unyank)).
+		Methods(http.MethodDelete)
+}
+
+// Docs describes the admin endpoints
+func (adc *AdminController) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/admin/gc", Method: http.MethodPost,
+			Summary: "Garbage collect archived versions by the retention " +
+				"rules",
+			Params: []ParamDoc{{Name: "dry-run", Type: "boolean",
+				Description: "Only report what would be deleted. " +
+					"Defaults to true."}},
+			Response: models.GCReport{}},
+		{Path: "/admin/deletions",
+			Summary: "List versions deleted by garbage collection",
+			Params: []ParamDoc{{Name: "run-id",
+				Description: "Only list deletions of this run"},
+				{Name: "path-name",
+					Description: "Only list deletions of this file"}},
+			Response: []models.Deletion{}},
+		{Path: "/admin/audit", Method: http.MethodPost,
+			Summary: "Start an audit of entries against stored objects. " +
+				"Responds 202 with the report so far.",
+			Params: []ParamDoc{{Name: "verify", Type: "boolean",
+				Description: "Compare object sizes and ETags with " +
+					"earlier audits. Objects are trusted the first time " +
+					"they're seen, and multipart ETags aren't checksums, " +
+					"so this only catches objects replaced or truncated " +
+					"since then. Defaults to the server's setting."}},
+			Response: models.AuditReport{}},
+		{Path: "/admin/audit",
+			Summary: "Get the report of an audit, which may still be " +
+				"running",
+			Params: []ParamDoc{{Name: "run-id",
+				Description: "Audit to get. Defaults to the latest."}},
+			Response: models.AuditReport{}},
+		{Path: "/admin/yank", Method: http.MethodPost,
+			Summary: "Yank a file version, so that points in time " +
+				"resolve past it. Yanking again replaces the reason.",
+			Params: []ParamDoc{pathNameParam, {Name: "version-num",
+				Type: "integer", Required: true,
+				Description: "Version to yank"},
+				{Name: "reason", Required: true,
+					Description: "Why the version shouldn't be used"},
+				{Name: "replacement", Type: "integer",
+					Description: "Version to use instead"}},
+			Response: models.Yank{}},
+		{Path: "/admin/yank", Method: http.MethodDelete,
+			Summary: "Unyank a file version",
+			Params: []ParamDoc{pathNameParam, {Name: "version-num",
+				Type: "integer", Required: true,
+				Description: "Version to unyank"}}},
+	}
+}
+
+// GC handles requests to run garbage collection. Runs are dry unless
+// dry-run=false is given.
+func (adc *AdminController) GC(w http.ResponseWriter, r *http.Request) {
+	dryRun := true
+	if value := r.URL.Query().Get("dry-run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			adc.SendError(w, utils.InvalidArgument("invalid_dry_run",
+				"Invalid dry-run "+value+".", err))
+			return
+		}
+	}
+	retention := models.NewRetention(adc.ctx.ForRequest(r))
+	result, err := retention.Collect(Principal(r), dryRun)
+	adc.DefaultResponse(w, r, result, err)
+}
+
+// Deletions handles requests for the garbage collection audit trail.
+func (adc *AdminController) Deletions(w http.ResponseWriter,
+	r *http.Request) {
+	query := r.URL.Query()
+	retention := models.NewRetention(adc.ctx.ForRequest(r))
+	result, err := retention.Deletions(query.Get("run-id"),
+		query.Get("path-name"))
+	adc.DefaultResponse(w, r, result, err)
+}
+
+// StartAudit handles requests to start an integrity audit.
+func (adc *AdminController) StartAudit(w http.ResponseWriter,
+	r *http.Request) {
+	verify := adc.ctx.Config.Audit.Verify
+	if value := r.URL.Query().Get("verify"); value != "" {
+		var err error
+		if verify, err = strconv.ParseBool(value); err != nil {
+			adc.SendError(w, utils.InvalidArgument("invalid_verify",
+				"Invalid verify "+value+".", err))
+			return
+		}
+	}
+	audit := models.NewAudit(adc.ctx.ForRequest(r))
+	result, err := audit.Start(verify)
+	if err != nil {
+		adc.SendError(w, err)
+		return
+	}
+	adc.ctx.Log.Info("Started audit.", "run", result.RunID,
+		"principal", Principal(r))
+	adc.OutputCode(w, r, http.StatusAccepted, result)
+}
+
+// ShowAudit handles requests for audit reports.
+func (adc *AdminController) ShowAudit(w http.ResponseWriter,
+	r *http.Request) {
+	audit := models.NewAudit(adc.ctx.ForRequest(r))
+	result, err := audit.Get(r.URL.Query().Get("run-id"))
+	adc.DefaultResponse(w, r, result, err)
+}
+
+// Yank handles requests to yank a file version.
+func (adc *AdminController) Yank(w http.ResponseWriter, r *http.Request) {
+	err := adc.RequireParams(r, "path-name", "version-num", "reason")
+	if err != nil {
+		adc.SendError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	yank := models.Yank{
+		Path:      query.Get("path-name"),
+		Reason:    query.Get("reason"),
+		Principal: Principal(r),
+	}
+	yank.Version, err = intParam(r, "version-num")
+	if err == nil && query.Get("replacement") != "" {
+		yank.Replacement, err = intParam(r, "replacement")
+	}
+	if err != nil {
+		adc.SendError(w, err)
+		return
+	}
+	result, err := models.NewYanks(adc.ctx.ForRequest(r)).Add(yank)
+	if err != nil {
+		adc.SendError(w, err)
+		return
+	}
+	adc.ctx.Log.Info("Yanked version.", "path", result.Path,
+		"version", result.Version, "replacement", result.Replacement,
+		"principal", result.Principal)
+	adc.Output(w, r, result)
+}
+
+// Unyank handles requests to unyank a file version.
+func (adc *AdminController) Unyank(w http.ResponseWriter,
+	r *http.Request) {
+	err := adc.RequireParams(r, "path-name", "version-num")
+	if err != nil {
+		adc.SendError(w, err)
+		return
+	}
+	pathName := r.URL.Query().Get("path-name")
+	version, err := intParam(r, "version-num")
+	if err == nil {
+		err = models.NewYanks(adc.ctx.ForRequest(r)).Remove(pathName,
+			version)
+	}
+	if err != nil {
+		adc.SendError(w, err)
+		return
+	}
+	adc.ctx.Log.Info("Unyanked version.", "path", pathName,
+		"version", version, "principal", Principal(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Gets a positive integer query parameter.
+func intParam(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	res, err := strconv.Atoi(value)
+	if err != nil || res < 1 {
+		return 0, utils.InvalidArgument("invalid_"+
+			strings.ReplaceAll(name, "-", "_"),
+			"Invalid "+name+" "+value+".", err)
+	}
+	return res, nil
+}
+
+// Wraps a handler so that only admins may call it.
+func (adc *AdminController) adminOnly(
+	next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := requireAdmin(adc.ctx, r); err != nil {
+			adc.SendError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,355 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (m mockStore) DeleteObjectWithContext(ctx aws.Context,
+	input *s3.DeleteObjectInput, opts ...request.Option) (
+	*s3.DeleteObjectOutput, error) {
+	delete(m.objects, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m mockStore) ListObjectsV2PagesWithContext(ctx aws.Context,
+	input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool,
+	opts ...request.Option) error {
+	out := &s3.ListObjectsV2Output{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key)})
+		}
+	}
+	fn(out, true)
+	return nil
+}
+
+// Makes a request to the router as principal.
+func requestAs(router *mux.Router, principal string, method string,
+	target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, nil)
+	r = r.WithContext(context.WithValue(r.Context(), principalKey,
+		principal))
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestGC(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/README", 1, "2017-01-01T00:00:00", "README-1"},
+		{"/blast/db/README", 2, "2017-07-01T00:00:00", nil},
+		{"/blast/db/nt.tar.gz", 1, "2017-01-05T00:00:00", "nt-1"},
+		{"/blast/db/nt.tar.gz", 2, "2017-01-20T00:00:00", "nt-2"},
+		{"/blast/db/nt.tar.gz", 3, "2017-02-10T00:00:00", "nt-3"},
+		{"/blast/db/nt.tar.gz", 4, "2017-03-01T00:00:00", nil},
+		{"/blast/db/nr.tar.gz", 1, "2017-01-01T00:00:00", "nr-1"},
+		{"/blast/db/nr.tar.gz", 2, "2017-01-02T00:00:00", "nr-2"},
+		{"/blast/db/nr.tar.gz", 3, "2017-01-03T00:00:00", "nr-3"},
+		{"/blast/db/nr.tar.gz", 4, "2017-04-01T00:00:00", nil},
+		{"/blast/db/env.tar.gz", 1, "2017-02-01T00:00:00", "env-1"},
+		{"/blast/db/env.tar.gz", 2, "2017-02-15T00:00:00", "env-2"},
+	})
+	objects := map[string]string{"/archive/nt-1": "nt", "/archive/nt-2": "nt"}
+	ctx.Store = mockStore{objects: objects}
+	_, err := ctx.Db.Exec("insert into pins values (?, ?, ?, ?, ?, ?)",
+		"/blast/db/nr.tar.gz", 2, "alice", "paper", nil,
+		"2017-05-01T00:00:00")
+	assert.Nil(t, err)
+	ctx.Config.Auth.Admins = []string{"alice"}
+	ctx.Config.Retention = utils.RetentionConfig{
+		Rules: []utils.RetentionRule{{Pattern: "/blast/db/*.tar.gz",
+			KeepLast: 1, MonthlyAfter: utils.Duration{Duration: 24 * time.Hour}}},
+		Snapshots: []string{"2017-01-01T12:00:00"},
+	}
+	router := mux.NewRouter()
+	NewAdminController(ctx).Register(router)
+
+	w := requestAs(router, "bob", "POST", "/admin/gc")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Dry runs are the default
+	w = requestAs(router, "alice", "POST", "/admin/gc")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report := models.GCReport{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 10, report.Checked)
+	// nr.tar.gz 1 is in the snapshot and 2 is pinned
+	assert.Equal(t, 2, report.Protected)
+	// env.tar.gz 2 is kept as the last and stands for its month
+	assert.Len(t, report.Deleted, 2)
+	assert.Contains(t, objects, "/archive/nt-1")
+
+	w = requestAs(router, "alice", "POST",
+		"/admin/gc?dry-run=false")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Len(t, report.Deleted, 2)
+	assert.Empty(t, report.Errors)
+	assert.NotContains(t, objects, "/archive/nt-1")
+	assert.Contains(t, objects, "/archive/nt-2")
+	var count int
+	assert.Nil(t, ctx.Db.QueryRow("select count(*) from entries where "+
+		"PathName = '/blast/db/nt.tar.gz'").Scan(&count))
+	assert.Equal(t, 3, count)
+
+	w = requestAs(router, "alice", "GET", "/admin/deletions?run-id="+
+		report.RunID)
+	assert.Equal(t, http.StatusOK, w.Code)
+	deletions := []models.Deletion{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &deletions))
+	assert.Len(t, deletions, 2)
+	for _, del := range deletions {
+		assert.Contains(t, []string{"/blast/db/env.tar.gz",
+			"/blast/db/nt.tar.gz"}, del.Path)
+		assert.Equal(t, 1, del.Version)
+		assert.Equal(t, "alice", del.Principal)
+	}
+}
+
+func TestGCKeepsSnapshotPastYank(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/nt.tar.gz", 1, "2017-01-01T00:00:00", "nt-1"},
+		{"/blast/db/nt.tar.gz", 2, "2017-01-10T00:00:00", "nt-2"},
+		{"/blast/db/nt.tar.gz", 3, "2017-03-01T00:00:00", nil},
+	})
+	ctx.Store = mockStore{objects: map[string]string{}}
+	_, err := ctx.Db.Exec("insert into yanks values (?, ?, ?, ?, ?, ?)",
+		"/blast/db/nt.tar.gz", 2, "corrupt", nil, "alice",
+		"2017-02-01T00:00:00")
+	assert.Nil(t, err)
+	ctx.Config.Auth.Admins = []string{"alice"}
+	ctx.Config.Retention = utils.RetentionConfig{
+		Rules: []utils.RetentionRule{{Pattern: "/blast/db/*.tar.gz",
+			KeepLast: 1}},
+		Snapshots: []string{"2017-02-01T00:00:00"},
+	}
+	router := mux.NewRouter()
+	NewAdminController(ctx).Register(router)
+
+	// The snapshot resolves past the yanked version 2 to version 1
+	w := requestAs(router, "alice", "POST", "/admin/gc")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report := models.GCReport{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 2, report.Protected)
+	assert.Empty(t, report.Deleted)
+}
+
+func TestGCKeepsSharedObjects(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/nt.tar.gz", 1, "2017-01-01T00:00:00", "nt-1"},
+		{"/blast/db/nt.tar.gz", 2, "2017-03-01T00:00:00", "nt-1"},
+	})
+	objects := map[string]string{"/archive/nt-1": "nt"}
+	ctx.Store = mockStore{objects: objects}
+	ctx.Config.Auth.Admins = []string{"alice"}
+	ctx.Config.Retention = utils.RetentionConfig{
+		Rules: []utils.RetentionRule{{Pattern: "/blast/db/*.tar.gz",
+			KeepLast: 1}},
+	}
+	router := mux.NewRouter()
+	NewAdminController(ctx).Register(router)
+
+	// Version 1's row goes, but version 2 still needs the object
+	w := requestAs(router, "alice", "POST", "/admin/gc")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report := models.GCReport{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Len(t, report.Deleted, 1)
+	assert.Empty(t, report.Errors)
+	assert.Contains(t, objects, "/archive/nt-1")
+}
+
+// Starts an audit as an admin and waits for its report.
+func runAudit(t *testing.T, router *mux.Router,
+	query string) models.AuditReport {
+	w := requestAs(router, "alice", "POST", "/admin/audit"+query)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	report := models.AuditReport{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	for i := 0; i < 100 && report.Finished == ""; i++ {
+		time.Sleep(20 * time.Millisecond)
+		w = requestAs(router, "alice", "GET", "/admin/audit?run-id="+
+			report.RunID)
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	}
+	assert.NotEmpty(t, report.Finished)
+	return report
+}
+
+func TestAudit(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/README", 1, "2017-01-01T00:00:00", "README-1"},
+		{"/blast/db/README", 2, "2017-07-01T00:00:00", "README-2"},
+		{"/blast/db/v4/nt.tar.gz", 1, "2017-02-01T00:00:00", nil},
+	})
+	objects := map[string]string{
+		"/archive/README-1":      "first version",
+		"/archive/stray":         "stray",
+		"/blast/db/v4/nt.tar.gz": "nt",
+	}
+	ctx.Store = mockStore{objects: objects}
+	ctx.Config.Auth.Admins = []string{"alice"}
+	ctx.Config.Audit.RequestsPerSecond = 1000
+	router := mux.NewRouter()
+	NewAdminController(ctx).Register(router)
+
+	w := requestAs(router, "alice", "GET", "/admin/audit")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	report := runAudit(t, router, "?verify=true")
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, 2, report.Listed)
+	assert.Equal(t, 1, report.Missing)
+	assert.Equal(t, 1, report.Orphaned)
+	assert.Equal(t, 0, report.Mismatched)
+	assert.Empty(t, report.Errors)
+	assert.Contains(t, report.Problems, models.AuditProblem{
+		Kind: models.ProblemMissing, Path: "/blast/db/README", Version: 2,
+		Key: "/archive/README-2"})
+	assert.Contains(t, report.Problems, models.AuditProblem{
+		Kind: models.ProblemOrphan, Key: "/archive/stray"})
+
+	objects["/archive/README-1"] = "changed"
+	report = runAudit(t, router, "?verify=true")
+	assert.Equal(t, 1, report.Mismatched)
+	w = requestAs(router, "alice", "GET", "/admin/audit")
+	assert.Contains(t, w.Body.String(), "size 7, recorded 13")
+}
+
+// An object store that can't be reached
+type downStore struct {
+	mockStore
+}
+
+func (downStore) HeadObjectWithContext(ctx aws.Context,
+	input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput,
+	error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestAuditCapsErrors(t *testing.T) {
+	rows := [][]interface{}{}
+	for i := 0; i < 150; i++ {
+		rows = append(rows, []interface{}{fmt.Sprintf("/f%03d", i), 1,
+			"2017-01-01T00:00:00", nil})
+	}
+	ctx := newTestContext(t, rows)
+	ctx.Store = downStore{mockStore{objects: map[string]string{}}}
+	ctx.Config.Auth.Admins = []string{"alice"}
+	ctx.Config.Audit.RequestsPerSecond = 10000
+	router := mux.NewRouter()
+	NewAdminController(ctx).Register(router)
+
+	report := runAudit(t, router, "")
+	assert.Equal(t, 150, report.Checked)
+	assert.Len(t, report.Errors, 100)
+	assert.Equal(t, 50, report.ErrorsDropped)
+}
+
+func TestAuditStopsOnShutdown(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/README", 1, "2017-01-01T00:00:00", "README-1"},
+	})
+	ctx.Store = mockStore{objects: map[string]string{}}
+	ctx.Config.Auth.Admins = []string{"alice"}
+	ctx.Config.Audit.RequestsPerSecond = 1
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	ctx.JobsCtx = jobsCtx
+	router := mux.NewRouter()
+	NewAdminController(ctx).Register(router)
+
+	stopJobs()
+	report := runAudit(t, router, "")
+	assert.True(t, report.Interrupted)
+	assert.Equal(t, 0, report.Checked)
+	assert.NotEmpty(t, report.Errors)
+}
+
+func TestYank(t *testing.T) {
+	ctx := newTestDav(t).ctx
+	ctx.Config.Auth.Admins = []string{"alice"}
+	ctx.Signer = fakeSigner{}
+	router := mux.NewRouter()
+	NewAdminController(ctx).Register(router)
+	NewFileController(ctx).Register(router)
+	readme := "?path-name=/blast/db/README"
+
+	w := requestAs(router, "bob", "POST", "/admin/yank"+readme+
+		"&version-num=2&reason=corrupt")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = requestAs(router, "alice", "POST", "/admin/yank"+readme+
+		"&version-num=3&reason=corrupt")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = requestAs(router, "alice", "POST", "/admin/yank"+readme+
+		"&version-num=2&reason=corrupt&replacement=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// At-time resolution skips the yanked version unless asked not to
+	atTime := "/file/at-time" + readme + "&input-time=2017-08-01"
+	entry := models.Entry{}
+	w = requestAs(router, "bob", "GET", atTime)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, 1, entry.Version)
+	w = requestAs(router, "bob", "GET", atTime+"&include-yanked=true")
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, 2, entry.Version)
+
+	w = requestAs(router, "bob", "GET", "/file/history"+readme)
+	history := []models.Entry{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Len(t, history, 2)
+	assert.Equal(t, "corrupt", history[0].Yanked.Reason)
+	assert.Nil(t, history[1].Yanked)
+
+	w = requestAs(router, "bob", "GET", "/file"+readme+"&version-num=2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Warning"), "Use version 1 instead.")
+
+	// Batches mark yanked versions, and skip them only at a time
+	items := `[{"Path": "/blast/db/README", "Version": 2},
+		{"Path": "/blast/db/README", "Time": "2017-08-01"}]`
+	for _, query := range []string{"", "?include-yanked=true"} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST",
+			"/batch/resolve"+query, strings.NewReader(items)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		res := []BatchResult{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, "corrupt", res[0].Entry.Yanked.Reason, query)
+		if query == "" {
+			assert.Equal(t, 1, res[1].Entry.Version)
+			assert.Nil(t, res[1].Entry.Yanked)
+		} else {
+			assert.Equal(t, 2, res[1].Entry.Version)
+			assert.NotNil(t, res[1].Entry.Yanked)
+		}
+	}
+
+	w = requestAs(router, "alice", "DELETE", "/admin/yank"+readme+
+		"&version-num=2")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = requestAs(router, "alice", "DELETE", "/admin/yank"+readme+
+		"&version-num=2")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = requestAs(router, "bob", "GET", atTime)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, 2, entry.Version)
+}
@@ -2,9 +2,10 @@ package controllers
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"ncbi-tool-server/utils"
 	"net/http"
+	"time"
 )
 
 // ApplicationController for general application functions
@@ -18,16 +19,52 @@ func NewApplicationController(
 	return &ApplicationController{ctx: ctx}
 }
 
-// ErrorResponse contains error information for the client
+// ErrorResponse contains error information for the client. Code is the
+// HTTP status and ErrorCode a stable machine-readable identifier for the
+// problem, like "file_not_found".
 type ErrorResponse struct {
-	Code  int
-	Error string
+	Code      int
+	ErrorCode string
+	Error     string
+}
+
+// statusClientClosedRequest is the nginx status for a request the client
+// gave up on. The client never sees it, but logs and metrics do.
+const statusClientClosedRequest = 499
+
+// HTTP status codes for each kind of domain error
+var statusForKind = map[utils.ErrorKind]int{
+	utils.KindInternal:         http.StatusInternalServerError,
+	utils.KindNotFound:         http.StatusNotFound,
+	utils.KindInvalidArgument:  http.StatusBadRequest,
+	utils.KindUnavailable:      http.StatusServiceUnavailable,
+	utils.KindForbidden:        http.StatusForbidden,
+	utils.KindDeadlineExceeded: http.StatusGatewayTimeout,
+	utils.KindConflict:         http.StatusConflict,
+	utils.KindCanceled:         statusClientClosedRequest,
+	utils.KindUnauthorized:     http.StatusUnauthorized,
+}
+
+// SendError sends an error to the client with the status code for its
+// kind. Errors without a kind are treated as server errors.
+func (ac *ApplicationController) SendError(w http.ResponseWriter,
+	err error) {
+	if utils.KindOf(err) == utils.KindUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	ac.ErrorOutput(w, errorResponse(err))
+}
+
+// Describes an error for the client with the status code for its kind.
+func errorResponse(err error) ErrorResponse {
+	return ErrorResponse{statusForKind[utils.KindOf(err)],
+		utils.CodeOf(err), "Error: " + err.Error()}
 }
 
 // InternalError sends an error for server errors to the client
 func (ac *ApplicationController) InternalError(w http.ResponseWriter,
 	err error) {
-	res := ErrorResponse{http.StatusInternalServerError,
+	res := ErrorResponse{http.StatusInternalServerError, "internal",
 		"Error: " + err.Error()}
 	ac.ErrorOutput(w, res)
 }
@@ -35,51 +72,120 @@ func (ac *ApplicationController) InternalError(w http.ResponseWriter,
 // BadRequest sends an error for badly formed requests to the client
 func (ac *ApplicationController) BadRequest(w http.ResponseWriter,
 	err error) {
-	res := ErrorResponse{http.StatusBadRequest,
+	res := ErrorResponse{http.StatusBadRequest, utils.CodeOf(err),
 		"Request error: " + err.Error()}
+	if res.ErrorCode == "internal" {
+		res.ErrorCode = "invalid_argument"
+	}
+	ac.ErrorOutput(w, res)
+}
+
+// Unauthorized sends an error for requests without valid credentials to
+// the client
+func (ac *ApplicationController) Unauthorized(w http.ResponseWriter,
+	err error) {
+	res := ErrorResponse{http.StatusUnauthorized, "unauthorized",
+		"Unauthorized: " + err.Error()}
+	w.Header().Set("WWW-Authenticate", "Bearer")
 	ac.ErrorOutput(w, res)
 }
 
+// RequireParams checks that the request has a value for each of the
+// named query parameters
+func (ac *ApplicationController) RequireParams(r *http.Request,
+	names ...string) error {
+	for _, name := range names {
+		if r.URL.Query().Get(name) == "" {
+			return utils.InvalidArgument("missing_parameter",
+				"Missing "+name+".", nil)
+		}
+	}
+	return nil
+}
+
+// CacheFor marks a response as cacheable by clients for maxAge. Used for
+// responses about past points in time, which don't change. A zero maxAge
+// leaves the response uncached.
+func (ac *ApplicationController) CacheFor(w http.ResponseWriter,
+	maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+	w.Header().Set("Cache-Control",
+		fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds())))
+}
+
 // ErrorOutput writes a error response to the client
 func (ac *ApplicationController) ErrorOutput(w http.ResponseWriter,
 	result ErrorResponse) {
 	js, err := json.Marshal(result)
 	if err != nil {
-		log.Print("Error with JSON marshal: " + err.Error())
+		writerLogger(w, ac.ctx.Log).Error("Error with JSON marshal.",
+			"error", err)
 		http.Error(w, "Error: "+err.Error(),
 			http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(result.Code)
 	_, err = w.Write(js)
 	if err != nil {
-		log.Print("Error writing JSON output: " + err.Error())
+		writerLogger(w, ac.ctx.Log).Error("Error writing JSON output.",
+			"error", err)
 	}
 }
 
-// Output marshals a struct into JSON format for output
+// Output formats a result for output. The format is picked by the
+// format= parameter or the Accept header: JSON, NDJSON, CSV, TSV or ls -l
+// style text. Only tabular results can be rendered as CSV, TSV or text;
+// others are sent as JSON.
 func (ac *ApplicationController) Output(w http.ResponseWriter,
-	result interface{}) {
+	r *http.Request, result interface{}) {
+	format, err := negotiateFormat(r)
+	if err != nil {
+		ac.SendError(w, err)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	out, contentType, err := render(format, result)
+	if err != nil {
+		ac.InternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(out)
+	if err != nil {
+		utils.LoggerFrom(r.Context(), ac.ctx.Log).Error(
+			"Error writing output.", "error", err)
+	}
+}
+
+// OutputCode marshals a struct into JSON format for output with the given
+// status code
+func (ac *ApplicationController) OutputCode(w http.ResponseWriter,
+	r *http.Request, code int, result interface{}) {
 	js, err := json.Marshal(result)
 	if err != nil {
 		ac.InternalError(w, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(code)
 	_, err = w.Write(js)
 	if err != nil {
-		log.Print("Error writing JSON output: " + err.Error())
+		utils.LoggerFrom(r.Context(), ac.ctx.Log).Error(
+			"Error writing JSON output.", "error", err)
 	}
 }
 
-// DefaultResponse returns a bad request error to the client or a formatted
-// JSON output.
+// DefaultResponse returns an error with the status code for its kind to
+// the client or a formatted output.
 func (ac *ApplicationController) DefaultResponse(w http.ResponseWriter,
-	result interface{}, err error) {
+	r *http.Request, result interface{}, err error) {
 	if err != nil {
-		ac.BadRequest(w, err)
+		ac.SendError(w, err)
 		return
 	}
-	ac.Output(w, result)
+	ac.Output(w, r, result)
 }
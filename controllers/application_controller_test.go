@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"ncbi-tool-server/models"
 	"ncbi-tool-server/utils"
@@ -11,8 +12,38 @@ import (
 func TestOutput(t *testing.T) {
 	ctx := utils.NewContext()
 	ac := NewApplicationController(ctx)
-	entry := models.Entry{"blast", 5, "2009-09-29T14:24:20Z", ""}
+	entry := models.Entry{Path: "blast", Version: 5,
+		ModTime: "2009-09-29T14:24:20Z"}
 	w := httptest.NewRecorder()
-	ac.Output(w, entry)
+	r := httptest.NewRequest("GET", "/file", nil)
+	ac.Output(w, r, entry)
 	assert.Equal(t, `{"Path":"blast","Version":5,"ModTime":"2009-09-29T14:24:20Z"}`, w.Body.String())
 }
+
+func TestSendError(t *testing.T) {
+	ctx := utils.NewContext()
+	ac := NewApplicationController(ctx)
+	cases := []struct {
+		err  error
+		code int
+		body string
+	}{
+		{utils.NotFound("file_not_found", "No results.", nil), 404,
+			`"ErrorCode":"file_not_found"`},
+		{utils.InvalidArgument("invalid_version", "Bad.", nil), 400,
+			`"ErrorCode":"invalid_version"`},
+		{utils.NewErr("Wrapped.", utils.Unavailable("database_unavailable",
+			"Down.", nil)), 503, `"ErrorCode":"database_unavailable"`},
+		{utils.Forbidden("pinned", "Pinned.", nil), 403,
+			`"ErrorCode":"pinned"`},
+		{utils.Unauthorized("token_required", "No token.", nil), 401,
+			`"ErrorCode":"token_required"`},
+		{errors.New("boom"), 500, `"ErrorCode":"internal"`},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		ac.SendError(w, c.err)
+		assert.Equal(t, c.code, w.Code)
+		assert.Contains(t, w.Body.String(), c.body)
+	}
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/gorilla/mux"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"strings"
+)
+
+// Type for request context keys set by this package
+type contextKey string
+
+// principalKey is the request context key for the authenticated principal
+const principalKey contextKey = "principal"
+
+// Paths that never need a token, so that probes and API discovery keep
+// working
+var publicPaths = map[string]bool{
+	"/healthz":      true,
+	"/readyz":       true,
+	"/openapi.json": true,
+}
+
+// Authenticate returns middleware that checks bearer tokens against the
+// configured tokens and records the principal on the request. A request
+// without a token is only refused if auth is required; a request with an
+// unknown token is always refused. S3 clients may sign requests with AWS
+// Signature Version 4 instead, using the principal as the access key ID
+// and a token as the secret key.
+func Authenticate(ctx *utils.Context) mux.MiddlewareFunc {
+	ac := ApplicationController{ctx: ctx}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			if publicPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var principal string
+			token := bearerToken(r)
+			switch {
+			case isSigV4(r):
+				var err error
+				principal, err = verifySigV4(r, ctx.Config.Auth.Tokens)
+				if err != nil {
+					ac.Unauthorized(w, err)
+					return
+				}
+			case token == "":
+				if ctx.Config.Auth.Required {
+					ac.Unauthorized(w, errors.New("missing API token"))
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			default:
+				principal = ctx.Config.Auth.Principal(token)
+				if principal == "" {
+					ac.Unauthorized(w, errors.New("invalid API token"))
+					return
+				}
+			}
+			if info := getRequestInfo(r); info != nil {
+				info.principal = principal
+			}
+			r = r.WithContext(context.WithValue(r.Context(), principalKey,
+				principal))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Principal returns the authenticated principal for a request, or an
+// empty string if the request had no token
+func Principal(r *http.Request) string {
+	res, _ := r.Context().Value(principalKey).(string)
+	return res
+}
+
+// Gets the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) < len(prefix) ||
+		!strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// requirePrincipal gets a request's principal, and fails as unauthorized
+// if the request had no token.
+func requirePrincipal(r *http.Request) (string, error) {
+	principal := Principal(r)
+	if principal == "" {
+		return "", utils.Unauthorized("token_required",
+			"This endpoint needs an API token.", nil)
+	}
+	return principal, nil
+}
+
+// requireAdmin checks that a request's principal is one of the configured
+// admins.
+func requireAdmin(ctx *utils.Context, r *http.Request) error {
+	principal := Principal(r)
+	for _, admin := range ctx.Config.Auth.Admins {
+		if principal != "" && subtle.ConstantTimeCompare([]byte(admin),
+			[]byte(principal)) == 1 {
+			return nil
+		}
+	}
+	return utils.Forbidden("admin_only",
+		"Only admins may use this endpoint.", nil)
+}
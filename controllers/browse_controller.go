@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"html/template"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// BrowseController serves Apache-style HTML directory indexes of the
+// mirror at a point in time, as in /browse/@2017-06-01/blast/db/. Files
+// under the same prefix are served as downloads, so recursive HTTP
+// mirroring with wget -r gets the past state.
+type BrowseController struct {
+	ApplicationController
+	ctx *utils.Context
+}
+
+// NewBrowseController returns a new controller instance
+func NewBrowseController(ctx *utils.Context) *BrowseController {
+	return &BrowseController{
+		ctx: ctx,
+	}
+}
+
+// Register registers the browse endpoint with the router
+func (bc *BrowseController) Register(router *mux.Router) {
+	router.PathPrefix("/browse/").HandlerFunc(bc.Serve).
+		Methods(http.MethodGet, http.MethodHead)
+}
+
+// Docs describes the browse endpoint
+func (bc *BrowseController) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/browse/", Summary: "HTML directory index of the mirror " +
+			"at a point in time, e.g. /browse/@2017-06-01/blast/db/. " +
+			"Files download from the same prefix, so wget --mirror works."},
+	}
+}
+
+// An entry in a directory index
+type indexEntry struct {
+	Name     string
+	Href     string
+	Modified string
+	Size     string
+}
+
+// Template for directory indexes, in the layout of Apache's autoindex
+var indexTemplate = template.Must(template.New("index").Funcs(
+	template.FuncMap{"pad": padName}).Parse(
+	`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+ <head>
+  <title>Index of {{.Path}}</title>
+ </head>
+ <body>
+<h1>Index of {{.Path}}</h1>
+<p>Snapshot at {{.Time}}</p>
+<pre>Name                                                Last modified      Size
+<hr>{{if .Parent}}<a href="../">Parent Directory</a>                                                          -
+{{end}}{{range .Entries}}<a href="{{.Href}}">{{.Name}}</a>{{pad .Name}} {{.Modified}}  {{.Size}}
+{{end}}<hr></pre>
+</body>
+</html>
+`))
+
+// Pads a name to line up the columns of an index.
+func padName(name string) string {
+	if len(name) >= 50 {
+		return " "
+	}
+	return strings.Repeat(" ", 51-len(name))
+}
+
+// Serve handles browse requests
+func (bc *BrowseController) Serve(w http.ResponseWriter, r *http.Request) {
+	seg, pathName, err := splitAtTime(strings.TrimPrefix(r.URL.Path,
+		"/browse"))
+	if err != nil {
+		bc.SendError(w, err)
+		return
+	}
+	inputTime, err := utils.ParsePointInTime(seg[1:])
+	if err != nil {
+		bc.SendError(w, err)
+		return
+	}
+	ctx := bc.ctx.ForRequest(r)
+	file := models.NewFile(ctx)
+	dir := models.NewDirectory(ctx)
+
+	// Try a file first, then redirect directories to the slashed path so
+	// relative links resolve
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		if pathName != "/" {
+			md, err := file.MetadataAtTime(r.Context(), pathName, inputTime)
+			if err == nil {
+				serveObject(w, r, file, md, bc.SendError)
+				return
+			}
+			if utils.KindOf(err) != utils.KindNotFound {
+				bc.SendError(w, err)
+				return
+			}
+			pathName += "/"
+			if _, _, err = dir.GetChildren(r.Context(), pathName, inputTime); err != nil {
+				bc.SendError(w, err)
+				return
+			}
+		}
+		target := davHref("/browse/"+seg, pathName)
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	files, dirs, err := dir.GetChildren(r.Context(), pathName, inputTime)
+	if err != nil {
+		bc.SendError(w, err)
+		return
+	}
+	infos, err := file.StatAll(r.Context(), files)
+	if err != nil {
+		bc.SendError(w, err)
+		return
+	}
+	entries := []indexEntry{}
+	for _, name := range dirs {
+		entries = append(entries, indexEntry{
+			Name: name + "/",
+			Href: (&url.URL{Path: "./" + name + "/"}).EscapedPath(),
+			Size: "-",
+		})
+	}
+	for i, md := range files {
+		name := path.Base(md.Path)
+		entry := indexEntry{
+			Name: name,
+			Href: (&url.URL{Path: "./" + name}).EscapedPath(),
+			Size: humanSize(infos[i].Size),
+		}
+		if infos[i].Missing {
+			entry.Size = "missing"
+		}
+		if modTime, ok := md.Modified(); ok {
+			entry.Modified = modTime.UTC().Format("2006-01-02 15:04")
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = indexTemplate.Execute(w, struct {
+		Path    string
+		Time    string
+		Parent  bool
+		Entries []indexEntry
+	}{pathName, inputTime, pathName != "/", entries})
+	if err != nil {
+		utils.LoggerFrom(r.Context(), bc.ctx.Log).Error(
+			"Error writing HTML output.", "error", err)
+	}
+}
+
+// Formats a size the way Apache's autoindex does, like "1.5K" or "12M".
+func humanSize(size int64) string {
+	value := float64(size)
+	for _, unit := range []string{"", "K", "M", "G", "T"} {
+		if value < 1024 || unit == "T" {
+			if unit == "" || value >= 10 {
+				return fmt.Sprintf("%.0f%s", value, unit)
+			}
+			return fmt.Sprintf("%.1f%s", value, unit)
+		}
+		value /= 1024
+	}
+	return ""
+}
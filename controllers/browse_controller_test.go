@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBrowseIndex(t *testing.T) {
+	bc := NewBrowseController(newTestDav(t).ctx)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/browse/@2017-06-01/blast/db/", nil)
+	bc.Serve(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, "<title>Index of /blast/db/</title>")
+	assert.Contains(t, body, `<a href="../">Parent Directory</a>`)
+	assert.Contains(t, body, `<a href="./v4/">v4/</a>`)
+	assert.Regexp(t, `<a href="./README">README</a> +2017-01-01 00:00  13`,
+		body)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/browse/@2017-06-01/blast/db", nil)
+	bc.Serve(w, r)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/browse/@2017-06-01/blast/db/", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/browse/@2017-06-01/blast/db/README", nil)
+	bc.Serve(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first version", w.Body.String())
+
+	// Files missing from the store are marked rather than failing the page
+	delete(bc.ctx.Store.(mockStore).objects, "/archive/README-1")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/browse/@2017-06-01/blast/db/", nil)
+	bc.Serve(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, `<a href="./README">README</a> +2017-01-01 00:00  missing`,
+		w.Body.String())
+}
+
+func TestHumanSize(t *testing.T) {
+	assert.Equal(t, "13", humanSize(13))
+	assert.Equal(t, "1.5K", humanSize(1536))
+	assert.Equal(t, "12M", humanSize(12<<20))
+}
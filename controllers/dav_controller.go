@@ -0,0 +1,294 @@
+package controllers
+
+import (
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"io"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// DavController serves a read-only WebDAV view of the mirror. The first
+// path segment picks the point in time, as in /dav/@2017-06-01/blast/db/
+// or /dav/@latest/blast/db/.
+type DavController struct {
+	ApplicationController
+	ctx *utils.Context
+}
+
+// NewDavController returns a new controller instance
+func NewDavController(ctx *utils.Context) *DavController {
+	return &DavController{
+		ctx: ctx,
+	}
+}
+
+// Register registers the WebDAV endpoint with the router
+func (dc *DavController) Register(router *mux.Router) {
+	router.PathPrefix("/dav/").HandlerFunc(dc.Serve)
+}
+
+// Docs describes the WebDAV endpoint
+func (dc *DavController) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/dav/", Summary: "Read-only WebDAV view of the mirror at a " +
+			"point in time, e.g. /dav/@2017-06-01/blast/db/ or " +
+			"/dav/@latest/blast/db/README. Supports OPTIONS, PROPFIND " +
+			"with Depth 0 or 1, GET and HEAD."},
+	}
+}
+
+// Serve handles WebDAV requests
+func (dc *DavController) Serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", "1")
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	seg, pathName, err := splitAtTime(strings.TrimPrefix(r.URL.Path, "/dav"))
+	if err != nil {
+		dc.sendError(w, r, err)
+		return
+	}
+	inputTime, err := utils.ParsePointInTime(seg[1:])
+	if err != nil {
+		dc.sendError(w, r, err)
+		return
+	}
+	ctx := dc.ctx.ForRequest(r)
+	base := "/dav/" + seg
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if strings.HasSuffix(pathName, "/") {
+			dc.sendError(w, r, utils.InvalidArgument("is_directory",
+				pathName+" is a directory. List it with PROPFIND.", nil))
+			return
+		}
+		file := models.NewFile(ctx)
+		md, err := file.MetadataAtTime(r.Context(), pathName, inputTime)
+		if err != nil {
+			dc.sendError(w, r, err)
+			return
+		}
+		serveObject(w, r, file, md, func(w http.ResponseWriter, err error) {
+			dc.sendError(w, r, err)
+		})
+	case "PROPFIND":
+		dc.propfind(w, r, ctx, base, pathName, inputTime)
+	default:
+		http.Error(w, "Read-only WebDAV.", http.StatusMethodNotAllowed)
+	}
+}
+
+// Splits a path like "/@2017-06-01/blast/db/" into the time segment,
+// like "@2017-06-01", and the mirror path.
+func splitAtTime(urlPath string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	if !strings.HasPrefix(parts[0], "@") {
+		return "", "", utils.InvalidArgument("missing_time",
+			"The path must start with a time like @2017-06-01 or @latest.",
+			nil)
+	}
+	pathName := "/"
+	if len(parts) == 2 {
+		pathName += parts[1]
+	}
+	return parts[0], pathName, nil
+}
+
+// WebDAV multistatus response body
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+// A resource in a multistatus response
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+// Properties of a resource with their status
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+// Properties of a file or collection
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+// Resource type, with a collection element for directories
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// Handles PROPFIND for a file or directory. All properties are returned
+// whatever the request body asks for. Depth infinity isn't supported.
+func (dc *DavController) propfind(w http.ResponseWriter, r *http.Request,
+	ctx *utils.Context, base string, pathName string, inputTime string) {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		dc.sendError(w, r, utils.Forbidden("propfind_finite_depth",
+			"PROPFIND needs Depth 0 or 1.", nil))
+		return
+	}
+	file := models.NewFile(ctx)
+	res := davMultistatus{Namespace: "DAV:"}
+
+	// Try a file first, then a directory
+	if !strings.HasSuffix(pathName, "/") {
+		md, err := file.MetadataAtTime(r.Context(), pathName, inputTime)
+		if err == nil {
+			info, err := file.Stat(r.Context(), md)
+			if err != nil {
+				dc.sendError(w, r, err)
+				return
+			}
+			res.Responses = append(res.Responses,
+				fileResponse(base, md, info))
+			dc.writeMultistatus(w, r, res)
+			return
+		}
+		if utils.KindOf(err) != utils.KindNotFound {
+			dc.sendError(w, r, err)
+			return
+		}
+		pathName += "/"
+	}
+
+	files, dirs, err := models.NewDirectory(ctx).GetChildren(r.Context(), pathName,
+		inputTime)
+	if err != nil {
+		dc.sendError(w, r, err)
+		return
+	}
+	res.Responses = append(res.Responses, dirResponse(base, pathName))
+	if depth == "1" {
+		infos, err := file.StatAll(r.Context(), files)
+		if err != nil {
+			dc.sendError(w, r, err)
+			return
+		}
+		for _, name := range dirs {
+			res.Responses = append(res.Responses,
+				dirResponse(base, pathName+name+"/"))
+		}
+		for i, md := range files {
+			if !infos[i].Missing {
+				res.Responses = append(res.Responses,
+					fileResponse(base, md, infos[i]))
+			}
+		}
+	}
+	dc.writeMultistatus(w, r, res)
+}
+
+// WebDAV error response body. Errors for a precondition, like a PROPFIND
+// without a finite depth, name it in an element of their own.
+type davErrorBody struct {
+	XMLName   xml.Name      `xml:"D:error"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Condition *davCondition `xml:",omitempty"`
+	Message   string        `xml:"D:responsedescription"`
+}
+
+// A precondition element in a WebDAV error
+type davCondition struct {
+	XMLName xml.Name
+}
+
+// Precondition elements for the error codes that have one
+var davConditions = map[string]string{
+	"propfind_finite_depth": "D:propfind-finite-depth",
+}
+
+// Sends a domain error as a WebDAV error with the status code for its
+// kind. HEAD responses have no body.
+func (dc *DavController) sendError(w http.ResponseWriter, r *http.Request,
+	err error) {
+	status := statusForKind[utils.KindOf(err)]
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	res := davErrorBody{Namespace: "DAV:", Message: err.Error()}
+	if name, ok := davConditions[utils.CodeOf(err)]; ok {
+		res.Condition = &davCondition{xml.Name{Local: name}}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	dc.writeXML(w, r, res)
+}
+
+// Describes a directory in a multistatus response.
+func dirResponse(base string, pathName string) davResponse {
+	return davResponse{
+		Href: davHref(base, pathName),
+		Propstat: davPropstat{
+			Prop: davProp{
+				DisplayName:  path.Base(pathName),
+				ResourceType: davResourceType{Collection: &struct{}{}},
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// Describes a file version in a multistatus response.
+func fileResponse(base string, md models.Metadata,
+	info models.ObjectInfo) davResponse {
+	size := info.Size
+	prop := davProp{
+		DisplayName:   path.Base(md.Path),
+		ContentLength: &size,
+		ContentType:   contentType(md, info),
+		ETag:          info.ETag,
+	}
+	if modTime, ok := md.Modified(); ok {
+		prop.LastModified = modTime.UTC().Format(http.TimeFormat)
+	}
+	return davResponse{
+		Href:     davHref(base, md.Path),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// Makes the escaped URL path of a mirror path under base.
+func davHref(base string, pathName string) string {
+	return (&url.URL{Path: base + pathName}).EscapedPath()
+}
+
+// Writes a 207 multistatus response.
+func (dc *DavController) writeMultistatus(w http.ResponseWriter,
+	r *http.Request, res davMultistatus) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	dc.writeXML(w, r, res)
+}
+
+// Writes an XML document.
+func (dc *DavController) writeXML(w http.ResponseWriter, r *http.Request,
+	res interface{}) {
+	_, err := io.WriteString(w, xml.Header)
+	if err == nil {
+		err = xml.NewEncoder(w).Encode(res)
+	}
+	if err != nil {
+		utils.LoggerFrom(r.Context(), dc.ctx.Log).Error(
+			"Error writing XML output.", "error", err)
+	}
+}
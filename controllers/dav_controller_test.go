@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// An object store holding the given contents by key
+type mockStore struct {
+	s3iface.S3API
+	objects map[string]string
+}
+
+func (m mockStore) HeadObjectWithContext(ctx aws.Context,
+	input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput,
+	error) {
+	data, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          aws.String(`"etag"`),
+	}, nil
+}
+
+func (m mockStore) GetObjectWithContext(ctx aws.Context,
+	input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput,
+	error) {
+	data, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New("NoSuchKey", "Not Found", nil)
+	}
+	if input.Range != nil {
+		var start, end int
+		fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end)
+		data = data[start : end+1]
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(strings.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+	}, nil
+}
+
+func newTestDav(t *testing.T) *DavController {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/README", 1, "2017-01-01T00:00:00", "README-1"},
+		{"/blast/db/README", 2, "2017-07-01T00:00:00", "README-2"},
+		{"/blast/db/v4/nt.tar.gz", 1, "2017-02-01T00:00:00", nil},
+	})
+	ctx.Store = mockStore{objects: map[string]string{
+		"/archive/README-1":      "first version",
+		"/archive/README-2":      "second version",
+		"/blast/db/v4/nt.tar.gz": "nt",
+	}}
+	return NewDavController(ctx)
+}
+
+func TestDavPropfind(t *testing.T) {
+	dc := newTestDav(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", "/dav/@2017-06-01/blast/db", nil)
+	r.Header.Set("Depth", "1")
+	dc.Serve(w, r)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, "<D:href>/dav/@2017-06-01/blast/db/</D:href>")
+	assert.Contains(t, body, "<D:href>/dav/@2017-06-01/blast/db/v4/</D:href>")
+	assert.Contains(t, body, "<D:href>/dav/@2017-06-01/blast/db/README</D:href>")
+	assert.Contains(t, body, "<D:getcontentlength>13</D:getcontentlength>")
+	assert.Contains(t, body,
+		"<D:getlastmodified>Sun, 01 Jan 2017 00:00:00 GMT</D:getlastmodified>")
+	assert.Equal(t, 3, strings.Count(body, "<D:response>"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PROPFIND", "/dav/@latest/blast/db/", nil)
+	dc.Serve(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "<D:propfind-finite-depth>")
+
+	// Files missing from the store are left out of listings
+	delete(dc.ctx.Store.(mockStore).objects, "/archive/README-1")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PROPFIND", "/dav/@2017-06-01/blast/db/", nil)
+	r.Header.Set("Depth", "1")
+	dc.Serve(w, r)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	body = w.Body.String()
+	assert.NotContains(t, body, "README")
+	assert.Equal(t, 2, strings.Count(body, "<D:response>"))
+}
+
+func TestDavPropfindWildcards(t *testing.T) {
+	dc := newTestDav(t)
+	// LIKE wildcards in paths match only themselves
+	for _, target := range []string{"/dav/@2017-06-01/blast/d_/",
+		"/dav/@2017-06-01/blast/%25/",
+		"/dav/@2017-06-01/" + strings.Repeat("%25", 20) + "/"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PROPFIND", target, nil)
+		r.Header.Set("Depth", "1")
+		dc.Serve(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code, target)
+	}
+}
+
+func TestDavGetRange(t *testing.T) {
+	dc := newTestDav(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/dav/@latest/blast/db/README", nil)
+	r.Header.Set("Range", "bytes=7-")
+	dc.Serve(w, r)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "version", w.Body.String())
+	assert.Equal(t, "bytes 7-13/14", w.Header().Get("Content-Range"))
+	assert.Equal(t, "7", w.Header().Get("Content-Length"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/dav/@2017-06-01/blast/db/README", nil)
+	r.Header.Set("Range", "bytes=20-")
+	dc.Serve(w, r)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(t, "bytes */13", w.Header().Get("Content-Range"))
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"encoding/json"
 	"github.com/gorilla/mux"
 	"ncbi-tool-server/models"
 	"ncbi-tool-server/utils"
@@ -8,6 +9,9 @@ import (
 	"time"
 )
 
+// streamFlushEvery is how many streamed entries are sent per flush
+const streamFlushEvery = 100
+
 // DirectoryController is for handling directory actions
 type DirectoryController struct {
 	ApplicationController
@@ -28,35 +32,143 @@ func (dc *DirectoryController) Register(router *mux.Router) {
 	router.HandleFunc("/directory/at-time", dc.AtTime)
 }
 
+// Docs describes the directory endpoints
+func (dc *DirectoryController) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/directory", Summary: "List a directory as it is now",
+			Params: []ParamDoc{pathNameParam, outputParam,
+				expiresInParam, dispositionParam, versionedNameParam},
+			Response: []models.Entry{}},
+		{Path: "/directory/compare",
+			Summary: "Compare a directory between two points in time",
+			Params: []ParamDoc{pathNameParam,
+				{Name: "start-date", Required: true,
+					Description: "Earlier point in time"},
+				{Name: "end-date", Required: true,
+					Description: "Later point in time"},
+				includeYankedParam},
+			Response: []models.CompareResponse{}},
+		{Path: "/directory/at-time",
+			Summary: "List a directory as it was at a point in time",
+			Params: []ParamDoc{pathNameParam, inputTimeParam, outputParam,
+				includeYankedParam, expiresInParam, dispositionParam,
+				versionedNameParam},
+			Response: []models.Entry{}},
+	}
+}
+
 // Show handles requests for showing a directory listing
 func (dc *DirectoryController) Show(w http.ResponseWriter,
 	r *http.Request) {
-	dir := models.NewDirectory(dc.ctx)
+	if err := dc.RequireParams(r, "path-name"); err != nil {
+		dc.SendError(w, err)
+		return
+	}
+	ctx, err := urlContext(dc.ctx, r)
+	if err != nil {
+		dc.SendError(w, err)
+		return
+	}
+	dir := models.NewDirectory(ctx)
 	pathName := utils.GetDirPath(r)
 	output := r.URL.Query().Get("output")
 	now := time.Now().Format("2006-01-02T03:04:05")
-	result, err := dir.GetPast(pathName, now, output)
-	dc.DefaultResponse(w, result, err)
+	if format, _ := negotiateFormat(r); format == formatNDJSON {
+		dc.streamListing(w, r, dir, pathName, now, output, 0)
+		return
+	}
+	result, err := dir.GetPast(r.Context(), pathName, now, output)
+	dc.DefaultResponse(w, r, result, err)
 }
 
 // Compare handles requests for comparing directory states at different times
 func (dc *DirectoryController) Compare(w http.ResponseWriter,
 	r *http.Request) {
-	dir := models.NewDirectory(dc.ctx)
+	err := dc.RequireParams(r, "path-name", "start-date", "end-date")
+	if err != nil {
+		dc.SendError(w, err)
+		return
+	}
+	dir := models.NewDirectory(dc.ctx.ForRequest(r))
 	pathName := utils.GetDirPath(r)
 	startDate := r.URL.Query().Get("start-date")
 	endDate := r.URL.Query().Get("end-date")
-	result, err := dir.CompareListing(pathName, startDate, endDate)
-	dc.DefaultResponse(w, result, err)
+	result, err := dir.CompareListing(r.Context(), pathName, startDate, endDate)
+	if err == nil {
+		dc.CacheFor(w, dc.ctx.Config.Cache.MaxAge.Duration)
+	}
+	dc.DefaultResponse(w, r, result, err)
 }
 
 // AtTime handles requests for a directory listing at a given time
 func (dc *DirectoryController) AtTime(w http.ResponseWriter,
 	r *http.Request) {
-	dir := models.NewDirectory(dc.ctx)
+	if err := dc.RequireParams(r, "path-name", "input-time"); err != nil {
+		dc.SendError(w, err)
+		return
+	}
+	ctx, err := urlContext(dc.ctx, r)
+	if err != nil {
+		dc.SendError(w, err)
+		return
+	}
+	dir := models.NewDirectory(ctx)
 	pathName := utils.GetDirPath(r)
 	inputTime := r.URL.Query().Get("input-time")
 	output := r.URL.Query().Get("output")
-	result, err := dir.GetPast(pathName, inputTime, output)
-	dc.DefaultResponse(w, result, err)
+	maxAge := dc.ctx.Config.Cache.MaxAge.Duration
+	if output == "with-URLs" {
+		maxAge = cacheAge(ctx)
+	}
+	if format, _ := negotiateFormat(r); format == formatNDJSON {
+		dc.streamListing(w, r, dir, pathName, inputTime, output, maxAge)
+		return
+	}
+	result, err := dir.GetPast(r.Context(), pathName, inputTime, output)
+	if err == nil {
+		dc.CacheFor(w, maxAge)
+	}
+	dc.DefaultResponse(w, r, result, err)
+}
+
+// Streams a directory listing as NDJSON, one entry per line, flushing
+// every streamFlushEvery entries. Errors before the first entry get a
+// normal error response. Later errors end the stream with an
+// ErrorResponse line, since the status has already been sent. Clients
+// may cache the stream for maxAge.
+func (dc *DirectoryController) streamListing(w http.ResponseWriter,
+	r *http.Request, dir *models.Directory, pathName string,
+	inputTime string, output string, maxAge time.Duration) {
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	count := 0
+	err := dir.StreamPast(r.Context(), pathName, inputTime, output,
+		func(entry models.Entry) error {
+			if count == 0 {
+				dc.CacheFor(w, maxAge)
+				w.Header().Add("Vary", "Accept")
+				w.Header().Set("Content-Type",
+					formatContentTypes[formatNDJSON])
+				w.WriteHeader(http.StatusOK)
+			}
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+			count++
+			if count%streamFlushEvery == 0 {
+				rc.Flush()
+			}
+			return nil
+		})
+	switch {
+	case err != nil && count == 0:
+		dc.SendError(w, err)
+	case err != nil:
+		utils.LoggerFrom(r.Context(), dc.ctx.Log).Error(
+			"Listing stream ended early.", "entries", count, "error", err)
+		enc.Encode(ErrorResponse{statusForKind[utils.KindOf(err)],
+			utils.CodeOf(err), "Error: " + err.Error()})
+	default:
+		rc.Flush()
+	}
 }
@@ -1,7 +1,18 @@
 package controllers
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 	//"ncbi_proj/server/utils"
 	//"net/http/httptest"
 	//"fmt"
@@ -16,3 +27,133 @@ func TestShow(t *testing.T) {
 	//dc.Show(w, r)
 	//fmt.Println(w.Body.String())
 }
+
+// Makes a context with an in-memory entries table holding the given rows
+// of PathName, VersionNum, DateModified and ArchiveKey, and the server's
+// own tables.
+func newTestContext(t *testing.T, rows [][]interface{}) *utils.Context {
+	ctx := utils.NewContext()
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	// Every connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("create table entries (PathName text, " +
+		"VersionNum integer, DateModified text, ArchiveKey text)")
+	assert.Nil(t, err)
+	for _, row := range rows {
+		_, err = db.Exec("insert into entries values (?, ?, ?, ?)", row...)
+		assert.Nil(t, err)
+	}
+	ctx.Db = db
+	assert.Nil(t, models.SetupTables(ctx))
+	return ctx
+}
+
+func TestAtTimeStream(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/README", 1, "2017-01-01T00:00:00", nil},
+		{"/blast/db/README", 2, "2017-07-01T00:00:00", nil},
+		{"/blast/db/nt.00.tar.gz", 1, "2017-02-01T00:00:00", "nt.00-1"},
+		{"/blast/db/v4/nt.tar.gz", 1, "2017-02-01T00:00:00", nil},
+	})
+	dc := NewDirectoryController(ctx)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/directory/at-time?path-name=blast/db"+
+		"&input-time=2017-06-01T00:00:00&format=ndjson", nil)
+	dc.AtTime(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.ElementsMatch(t, []string{
+		`{"Path":"/blast/db/README","Version":1,` +
+			`"ModTime":"2017-01-01T00:00:00"}`,
+		`{"Path":"/blast/db/nt.00.tar.gz","Version":1,` +
+			`"ModTime":"2017-02-01T00:00:00"}`,
+	}, lines)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/directory/at-time?path-name=nope"+
+		"&input-time=2017-06-01T00:00:00&format=ndjson", nil)
+	dc.AtTime(w, r)
+	assert.Equal(t, 404, w.Code)
+	assert.Contains(t, w.Body.String(), "directory_not_found")
+}
+
+// A signer that puts the options it was given in its URLs
+type optionsSigner struct{}
+
+func (optionsSigner) SignURL(ctx context.Context, key string,
+	expiresIn time.Duration, disposition string) (string, error) {
+	return fmt.Sprintf("signed:%s:%s:%s", key, expiresIn, disposition), nil
+}
+
+func TestAtTimeURLOptions(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/blast/db/README", 1, "2017-01-01T00:00:00", nil},
+	})
+	ctx.Signer = optionsSigner{}
+	dc := NewDirectoryController(ctx)
+	query := "/directory/at-time?path-name=blast/db" +
+		"&input-time=2017-06-01T00:00:00&output=with-URLs&expires-in=2h" +
+		"&disposition=inline&versioned-name=true"
+
+	for _, format := range []string{"json", "ndjson"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", query+"&format="+format, nil)
+		dc.AtTime(w, r)
+		assert.Equal(t, 200, w.Code, format)
+		assert.Contains(t, w.Body.String(), ":2h0m0s:inline; "+
+			"filename=README.v1", format)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", strings.Replace(query, "2h", "soon",
+		1), nil)
+	dc.AtTime(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// A response writer for a client that reads slowly
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w slowWriter) Write(data []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestStreamOutlastsQueryTimeout(t *testing.T) {
+	rows := [][]interface{}{}
+	for i := 0; i < 40; i++ {
+		rows = append(rows, []interface{}{fmt.Sprintf("/blast/db/nt.%02d", i),
+			1, "2017-02-01T00:00:00", nil})
+	}
+	ctx := newTestContext(t, rows)
+	ctx.Config.Query.Timeout = utils.Duration{Duration: 50 * time.Millisecond}
+	dc := NewDirectoryController(ctx)
+
+	// Reading the rows waits on the client for longer than the timeout
+	w := slowWriter{httptest.NewRecorder(), 5 * time.Millisecond}
+	r := httptest.NewRequest("GET", "/directory/at-time?path-name=blast/db"+
+		"&input-time=2017-06-01T00:00:00&format=ndjson", nil)
+	dc.AtTime(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "ErrorCode")
+	assert.Equal(t, 40, strings.Count(w.Body.String(), "\n"))
+}
+
+func TestAtTimeQueryTimeout(t *testing.T) {
+	ctx := newTestContext(t, nil)
+	ctx.Config.Query.Timeout = utils.Duration{Duration: time.Nanosecond}
+	dc := NewDirectoryController(ctx)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/directory/at-time?path-name=blast/db"+
+		"&input-time=2017-06-01T00:00:00", nil)
+	dc.AtTime(w, r)
+	assert.Equal(t, 504, w.Code)
+	assert.Contains(t, w.Body.String(), "query_timeout")
+}
@@ -1,13 +1,29 @@
 package controllers
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"ncbi-tool-server/models"
 	"ncbi-tool-server/utils"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// maxBatchItems bounds the items in one batch request
+const maxBatchItems = 1000
+
+// maxBatchBytes bounds the size of a batch request body
+const maxBatchBytes = 1 << 20
+
+// BatchResult is the result for one item of a batch: the file version,
+// or why it couldn't be resolved
+type BatchResult struct {
+	Entry *models.Entry  `json:",omitempty"`
+	Error *ErrorResponse `json:",omitempty"`
+}
+
 // FileController is for handling file actions
 type FileController struct {
 	ApplicationController
@@ -26,48 +42,343 @@ func (fc *FileController) Register(router *mux.Router) {
 	router.HandleFunc("/file", fc.Show)
 	router.HandleFunc("/file/history", fc.History)
 	router.HandleFunc("/file/at-time", fc.AtTime)
+	router.HandleFunc("/download", fc.Download)
+	router.HandleFunc("/file/restore", fc.RestoreStatus).
+		Methods(http.MethodGet)
+	router.HandleFunc("/file/restore", fc.Restore).
+		Methods(http.MethodPost)
+	router.HandleFunc("/batch/resolve", fc.Resolve).
+		Methods(http.MethodPost)
+}
+
+// Docs describes the file endpoints
+func (fc *FileController) Docs() []RouteDoc {
+	versionParams := []ParamDoc{pathNameParam, {Name: "version-num",
+		Type:        "integer",
+		Description: "Version to get. Defaults to the latest."},
+		{Name: "input-time",
+			Description: "Get the version at this point in time instead"},
+		includeYankedParam}
+	return []RouteDoc{
+		{Path: "/file", Summary: "Get a version of a file",
+			Params: []ParamDoc{pathNameParam, {Name: "version-num",
+				Type:        "integer",
+				Description: "Version to get. Defaults to the latest."},
+				expiresInParam, dispositionParam, versionedNameParam},
+			Response: models.Entry{}},
+		{Path: "/file/history", Summary: "List the versions of a file",
+			Params:   []ParamDoc{pathNameParam},
+			Response: []models.Entry{}},
+		{Path: "/file/at-time",
+			Summary: "Get the version of a file at a point in time",
+			Params: []ParamDoc{pathNameParam, inputTimeParam,
+				includeYankedParam, expiresInParam, dispositionParam,
+				versionedNameParam},
+			Response: models.Entry{}},
+		{Path: "/download",
+			Summary: "Download a version of a file. Redirects to a " +
+				"presigned URL or streams the file with Range support, " +
+				"depending on the server's download mode.",
+			Params: append(versionParams, expiresInParam, dispositionParam,
+				versionedNameParam)},
+		{Path: "/file/restore",
+			Summary: "Check whether a version in cold storage can be " +
+				"downloaded, or how far along its restore is",
+			Params:   versionParams,
+			Response: models.RestoreInfo{}},
+		{Path: "/file/restore", Method: http.MethodPost,
+			Summary: "Restore a version from cold storage so it can be " +
+				"downloaded for a while. Responds 202 while restoring. " +
+				"Needs an API token, since restores are paid for.",
+			Params:   versionParams,
+			Response: models.RestoreInfo{}},
+		{Path: "/batch/resolve", Method: http.MethodPost,
+			Summary: fmt.Sprintf("Resolve up to %d file versions at once. "+
+				"Each item has a Path and a Version or Time, or neither "+
+				"for the latest version. Results are in the same order.",
+				maxBatchItems),
+			Params: []ParamDoc{includeYankedParam, expiresInParam,
+				dispositionParam, versionedNameParam},
+			Body:     []models.BatchItem{},
+			Response: []BatchResult{}},
+	}
 }
 
 // Show handles requests for showing file information
 func (fc *FileController) Show(w http.ResponseWriter,
 	r *http.Request) {
 	// Setup
-	file := models.NewFile(fc.ctx)
+	ctx, err := urlContext(fc.ctx, r)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	file := models.NewFile(ctx)
 	pathName := r.URL.Query().Get("path-name")
-	var err error
 	var result models.Entry
 	versionNum := r.URL.Query().Get("version-num")
 
 	// Dispatch operations
 	switch {
 	case pathName == "":
-		fc.BadRequest(w, errors.New("empty pathName"))
+		fc.SendError(w, fc.RequireParams(r, "path-name"))
 		return
 	case versionNum != "":
 		// Serve up file version
-		result, err = file.GetVersion(pathName, versionNum)
+		result, err = file.GetVersion(r.Context(), pathName, versionNum)
+		if err == nil {
+			fc.CacheFor(w, cacheAge(ctx))
+			result.Yanked, err = fc.warnYanked(w, ctx, result.Path,
+				result.Version)
+		}
 	default:
 		// Serve up the file, latest version
-		result, err = file.GetVersion(pathName, "0")
+		result, err = file.GetVersion(r.Context(), pathName, "0")
+	}
+	if err == nil {
+		fc.linkVersion(w, r, file, result)
 	}
-	fc.DefaultResponse(w, result, err)
+	fc.DefaultResponse(w, r, result, err)
 }
 
 // History handles requests for showing file version history.
 func (fc *FileController) History(w http.ResponseWriter,
 	r *http.Request) {
-	file := models.NewFile(fc.ctx)
+	if err := fc.RequireParams(r, "path-name"); err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	file := models.NewFile(fc.ctx.ForRequest(r))
 	pathName := r.URL.Query().Get("path-name")
-	result, err := file.GetHistory(pathName)
-	fc.DefaultResponse(w, result, err)
+	result, err := file.GetHistory(r.Context(), pathName)
+	fc.DefaultResponse(w, r, result, err)
 }
 
 // AtTime handles requests for getting a file version at a point in time.
 func (fc *FileController) AtTime(w http.ResponseWriter,
 	r *http.Request) {
-	file := models.NewFile(fc.ctx)
+	if err := fc.RequireParams(r, "path-name", "input-time"); err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	ctx, err := urlContext(fc.ctx, r)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	file := models.NewFile(ctx)
 	pathName := r.URL.Query().Get("path-name")
 	inputTime := r.URL.Query().Get("input-time")
-	result, err := file.GetAtTime(pathName, inputTime)
-	fc.DefaultResponse(w, result, err)
+	result, err := file.GetAtTime(r.Context(), pathName, inputTime)
+	if err == nil {
+		fc.CacheFor(w, cacheAge(ctx))
+		fc.linkVersion(w, r, file, result)
+	}
+	fc.DefaultResponse(w, r, result, err)
+}
+
+// Download handles requests for the contents of a file version, either
+// by redirecting to a presigned URL or by streaming the object.
+func (fc *FileController) Download(w http.ResponseWriter,
+	r *http.Request) {
+	if err := fc.RequireParams(r, "path-name"); err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	ctx, err := urlContext(fc.ctx, r)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	file := models.NewFile(ctx)
+	md, err := fc.pickVersion(r, file)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	if r.URL.Query().Get("version-num") != "" ||
+		r.URL.Query().Get("input-time") != "" {
+		fc.CacheFor(w, cacheAge(ctx))
+	}
+	if r.URL.Query().Get("version-num") != "" {
+		if _, err = fc.warnYanked(w, ctx, md.Path, md.Version); err != nil {
+			fc.SendError(w, err)
+			return
+		}
+	}
+
+	if fc.ctx.Config.Download.Mode == "proxy" {
+		w.Header().Set("Content-Disposition", file.Disposition(md))
+		serveObject(w, r, file, md, fc.SendError)
+		return
+	}
+	if fc.ctx.Config.Signing.CloudFront.Cookies {
+		url, cookies, ok, err := file.SignCookies(r.Context(), md)
+		if err != nil {
+			fc.SendError(w, err)
+			return
+		}
+		if ok {
+			for _, cookie := range cookies {
+				http.SetCookie(w, cookie)
+			}
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+	}
+	url, err := file.URL(r.Context(), md)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// RestoreStatus handles requests for the restore status of a file
+// version.
+func (fc *FileController) RestoreStatus(w http.ResponseWriter,
+	r *http.Request) {
+	if err := fc.RequireParams(r, "path-name"); err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	file := models.NewFile(fc.ctx.ForRequest(r))
+	md, err := fc.pickVersion(r, file)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	result, err := file.RestoreStatus(r.Context(), md)
+	fc.DefaultResponse(w, r, result, err)
+}
+
+// Restore handles requests to restore a file version from cold storage.
+func (fc *FileController) Restore(w http.ResponseWriter,
+	r *http.Request) {
+	err := fc.RequireParams(r, "path-name")
+	if err == nil {
+		_, err = requirePrincipal(r)
+	}
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	file := models.NewFile(fc.ctx.ForRequest(r))
+	md, err := fc.pickVersion(r, file)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	result, err := file.Restore(r.Context(), md)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	fc.ctx.Log.Info("Requested restore.", "path", result.Path,
+		"version", result.Version, "status", result.Status,
+		"principal", Principal(r))
+	if result.Status == models.StatusRestoring {
+		fc.OutputCode(w, r, http.StatusAccepted, result)
+		return
+	}
+	fc.Output(w, r, result)
+}
+
+// Resolve handles requests for many file versions at once. Items that
+// can't be resolved get an error in their place rather than failing the
+// whole batch.
+func (fc *FileController) Resolve(w http.ResponseWriter,
+	r *http.Request) {
+	ctx, err := urlContext(fc.ctx, r)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	items := []models.BatchItem{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&items); err != nil {
+		fc.SendError(w, utils.InvalidArgument("invalid_batch",
+			"The body must be a JSON list of items like "+
+				`{"Path": "/blast/db/README", "Version": 2}.`, err))
+		return
+	}
+	if len(items) > maxBatchItems {
+		fc.SendError(w, utils.InvalidArgument("batch_too_large",
+			fmt.Sprintf("A batch can have at most %d items.", maxBatchItems),
+			nil))
+		return
+	}
+
+	entries, errs, err := models.NewFile(ctx).ResolveBatch(r.Context(), items)
+	if err != nil {
+		fc.SendError(w, err)
+		return
+	}
+	res := make([]BatchResult, len(items))
+	for i := range items {
+		if errs[i] != nil {
+			errRes := errorResponse(errs[i])
+			res[i].Error = &errRes
+			continue
+		}
+		res[i].Entry = &entries[i]
+	}
+	fc.Output(w, r, res)
+}
+
+// Gets the metadata of the file version a request asks for by
+// version-num or input-time, or of the latest version if neither is given.
+func (fc *FileController) pickVersion(r *http.Request,
+	file *models.File) (models.Metadata, error) {
+	query := r.URL.Query()
+	pathName := query.Get("path-name")
+	versionNum := query.Get("version-num")
+	inputTime := query.Get("input-time")
+	switch {
+	case versionNum != "" && inputTime != "":
+		return models.Metadata{}, utils.InvalidArgument(
+			"conflicting_params",
+			"Give either version-num or input-time, not both.", nil)
+	case inputTime != "":
+		return file.MetadataAtTime(r.Context(), pathName, inputTime)
+	}
+	num := 0
+	if versionNum != "" {
+		var err error
+		num, err = strconv.Atoi(versionNum)
+		if err != nil || num < 0 {
+			return models.Metadata{}, utils.InvalidArgument(
+				"invalid_version", "Invalid version-num "+versionNum+".",
+				err)
+		}
+	}
+	return file.MetadataForVersion(r.Context(), pathName, num)
+}
+
+// Sets a Warning header if a version the client asked for by number is
+// yanked, and returns the yank.
+func (fc *FileController) warnYanked(w http.ResponseWriter,
+	ctx *utils.Context, pathName string, version int) (*models.Yank,
+	error) {
+	yank, err := models.NewYanks(ctx).Get(pathName, version)
+	if err != nil || yank == nil {
+		return nil, err
+	}
+	quoter := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	w.Header().Set("Warning", `299 - "`+quoter.Replace(yank.Warning())+`"`)
+	return yank, nil
+}
+
+// Sets Memento links for a file version response. The links are left out
+// if the adjacent versions can't be read, since the version itself is
+// fine.
+func (fc *FileController) linkVersion(w http.ResponseWriter,
+	r *http.Request, file *models.File, result models.Entry) {
+	versions, err := file.GetAdjacent(r.Context(), result.Path,
+		result.Version)
+	if err != nil {
+		return
+	}
+	setVersionLinks(w, result.Path, versions, result.Version)
 }
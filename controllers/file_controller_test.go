@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A URL signer that marks keys as signed
+type fakeSigner struct{}
+
+func (fakeSigner) SignURL(ctx context.Context, key string,
+	expiresIn time.Duration, disposition string) (string, error) {
+	return "signed:" + key, nil
+}
+
+// An object store whose objects with a Restore header value are in
+// GLACIER. An empty value means not restored.
+type coldStore struct {
+	mockStore
+	restores map[string]string
+	requests []*s3.RestoreObjectInput
+}
+
+func (c *coldStore) HeadObjectWithContext(ctx aws.Context,
+	input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput,
+	error) {
+	out, err := c.mockStore.HeadObjectWithContext(ctx, input, opts...)
+	if restore, ok := c.restores[*input.Key]; ok && err == nil {
+		out.StorageClass = aws.String(s3.StorageClassGlacier)
+		if restore != "" {
+			out.Restore = aws.String(restore)
+		}
+	}
+	return out, err
+}
+
+func (c *coldStore) RestoreObjectWithContext(ctx aws.Context,
+	input *s3.RestoreObjectInput, opts ...request.Option) (
+	*s3.RestoreObjectOutput, error) {
+	c.requests = append(c.requests, input)
+	c.restores[*input.Key] = `ongoing-request="true"`
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func TestDownloadProxy(t *testing.T) {
+	ctx := newTestDav(t).ctx
+	ctx.Config.Download.Mode = "proxy"
+	fc := NewFileController(ctx)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/download?path-name=/blast/db/README&"+
+		"input-time=2017-06-01T00:00:00", nil)
+	r.Header.Set("Range", "bytes=6-")
+	fc.Download(w, r)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "version", w.Body.String())
+	assert.Equal(t, "7", w.Header().Get("Content-Length"))
+	assert.Equal(t, "attachment; filename=README",
+		w.Header().Get("Content-Disposition"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/download?path-name=/blast/db/README", nil)
+	fc.Download(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "second version", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/download?path-name=/blast/db/README&"+
+		"version-num=1&input-time=2017-06-01", nil)
+	fc.Download(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDownloadOptions(t *testing.T) {
+	ctx := newTestDav(t).ctx
+	ctx.Config.Download.Mode = "proxy"
+	fc := NewFileController(ctx)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/download?path-name=/blast/db/README&"+
+		"version-num=1&disposition=inline&versioned-name=true", nil)
+	fc.Download(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "inline; filename=README.v1",
+		w.Header().Get("Content-Disposition"))
+
+	for _, query := range []string{"expires-in=1000h", "expires-in=soon",
+		"disposition=open", "versioned-name=maybe"} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/download?path-name=/blast/db/"+
+			"README&"+query, nil)
+		fc.Download(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestBatchResolve(t *testing.T) {
+	ctx := newTestDav(t).ctx
+	ctx.Signer = fakeSigner{}
+	fc := NewFileController(ctx)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/batch/resolve", strings.NewReader(`[
+		{"Path": "/blast/db/README", "Time": "2017-06-01"},
+		{"Path": "/blast/db/README"},
+		{"Path": "/blast/db/README", "Version": 3},
+		{"Path": "/blast/db/v4/nt.tar.gz", "Version": 1}]`))
+	fc.Resolve(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	res := []BatchResult{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, 4, len(res))
+	assert.Equal(t, 1, res[0].Entry.Version)
+	assert.Equal(t, "signed:/archive/README-1", res[0].Entry.URL)
+	assert.Equal(t, 2, res[1].Entry.Version)
+	assert.Nil(t, res[2].Entry)
+	assert.Equal(t, "file_not_found", res[2].Error.ErrorCode)
+	assert.Equal(t, "signed:/blast/db/v4/nt.tar.gz", res[3].Entry.URL)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/batch/resolve",
+		strings.NewReader(`{"Path": "/blast/db/README"}`))
+	fc.Resolve(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRestore(t *testing.T) {
+	ctx := newTestDav(t).ctx
+	store := &coldStore{mockStore: ctx.Store.(mockStore),
+		restores: map[string]string{"/archive/README-1": ""}}
+	ctx.Store = store
+	ctx.Signer = fakeSigner{}
+	ctx.Config.Cold.Check = true
+	router := mux.NewRouter()
+	NewFileController(ctx).Register(router)
+	get := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	version1 := "?path-name=/blast/db/README&version-num=1"
+
+	w := get("GET", "/file"+version1)
+	assert.Equal(t, http.StatusOK, w.Code)
+	entry := models.Entry{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, models.StatusRestoreRequired, entry.Status)
+	assert.Empty(t, entry.URL)
+	w = get("GET", "/file?path-name=/blast/db/README")
+	assert.Contains(t, w.Body.String(), "signed:/archive/README-2")
+
+	w = get("GET", "/file/restore"+version1)
+	info := models.RestoreInfo{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "GLACIER", info.StorageClass)
+	assert.Equal(t, models.StatusRestoreRequired, info.Status)
+
+	// Restores are paid for, so they need a token
+	w = get("POST", "/file/restore"+version1)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	assert.Empty(t, store.requests)
+	w = requestAs(router, "alice", "POST", "/file/restore"+version1)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, store.requests, 1)
+	assert.Equal(t, int64(7), *store.requests[0].RestoreRequest.Days)
+	w = requestAs(router, "alice", "POST", "/file/restore"+version1)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, store.requests, 1)
+
+	w = get("GET", "/download"+version1)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"ErrorCode":"restoring"`)
+
+	store.restores["/archive/README-1"] = `ongoing-request="false", ` +
+		`expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`
+	w = get("GET", "/file/restore"+version1)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, models.StatusRestored, info.Status)
+	assert.Equal(t, "2012-12-21T00:00:00", info.Expires)
+	w = get("GET", "/download"+version1)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "signed:/archive/README-1", w.Header().Get("Location"))
+}
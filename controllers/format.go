@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatTSV    = "tsv"
+	formatText   = "text"
+)
+
+// Content types for each output format
+var formatContentTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatNDJSON: "application/x-ndjson",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatTSV:    "text/tab-separated-values; charset=utf-8",
+	formatText:   "text/plain; charset=utf-8",
+}
+
+// Output formats for each media type a client may accept
+var mediaTypeFormats = map[string]string{
+	"application/json":          formatJSON,
+	"application/x-ndjson":      formatNDJSON,
+	"application/ndjson":        formatNDJSON,
+	"text/csv":                  formatCSV,
+	"text/tab-separated-values": formatTSV,
+	"text/plain":                formatText,
+	"text/*":                    formatText,
+	"application/*":             formatJSON,
+	"*/*":                       formatJSON,
+}
+
+// Tabular is implemented by results that can be rendered as table rows.
+// Every format lists the columns in the same order.
+type Tabular interface {
+	Columns() []string
+	Row() []string
+}
+
+// Picks the output format for a request. A format= parameter wins over
+// the Accept header. JSON is the default.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", utils.InvalidArgument("invalid_format",
+				"Unknown format "+format+".", nil)
+		}
+		return format, nil
+	}
+
+	// Take the supported media type with the highest quality, keeping
+	// the client's order between equal qualities
+	type candidate struct {
+		format  string
+		quality float64
+	}
+	candidates := []candidate{}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := mediaTypeFormats[mediaType]
+		if !ok {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			candidates = append(candidates, candidate{format, quality})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	if len(candidates) == 0 {
+		return formatJSON, nil
+	}
+	return candidates[0].format, nil
+}
+
+// Gets the rows of a result that is a Tabular value or a slice of them.
+// Returns false for any other result.
+func tableRows(result interface{}) ([]string, [][]string, bool) {
+	if row, ok := result.(Tabular); ok {
+		return row.Columns(), [][]string{row.Row()}, true
+	}
+	val := reflect.ValueOf(result)
+	if val.Kind() != reflect.Slice {
+		return nil, nil, false
+	}
+	elem, ok := reflect.Zero(val.Type().Elem()).Interface().(Tabular)
+	if !ok {
+		return nil, nil, false
+	}
+	rows := [][]string{}
+	for i := 0; i < val.Len(); i++ {
+		rows = append(rows, val.Index(i).Interface().(Tabular).Row())
+	}
+	return elem.Columns(), rows, true
+}
+
+// Writes a result as one JSON value per line. Slices are written one
+// element per line.
+func writeNDJSON(out io.Writer, result interface{}) error {
+	enc := json.NewEncoder(out)
+	val := reflect.ValueOf(result)
+	if val.Kind() != reflect.Slice {
+		return enc.Encode(result)
+	}
+	for i := 0; i < val.Len(); i++ {
+		if err := enc.Encode(val.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes rows as CSV or TSV with a header line.
+func writeDelimited(out io.Writer, comma rune, columns []string,
+	rows [][]string) error {
+	writer := csv.NewWriter(out)
+	writer.Comma = comma
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+// Writes rows as aligned columns without a header, like ls -l. Empty
+// trailing cells are dropped.
+func writeText(out io.Writer, rows [][]string) error {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		end := len(row)
+		for end > 0 && row[end-1] == "" {
+			end--
+		}
+		if _, err := io.WriteString(writer,
+			strings.Join(row[:end], "\t")+"\n"); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// Renders a result in the given format. Results that aren't tabular can
+// only be rendered as JSON or NDJSON, so other formats fall back to JSON.
+func render(format string, result interface{}) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	columns, rows, ok := tableRows(result)
+	if !ok && format != formatNDJSON {
+		format = formatJSON
+	}
+	var err error
+	switch format {
+	case formatJSON:
+		var js []byte
+		js, err = json.Marshal(result)
+		buf.Write(js)
+	case formatNDJSON:
+		err = writeNDJSON(buf, result)
+	case formatCSV:
+		err = writeDelimited(buf, ',', columns, rows)
+	case formatTSV:
+		err = writeDelimited(buf, '\t', columns, rows)
+	case formatText:
+		err = writeText(buf, rows)
+	}
+	return buf.Bytes(), formatContentTypes[format], err
+}
@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOutputFormats(t *testing.T) {
+	ac := NewApplicationController(utils.NewContext())
+	listing := []models.Entry{
+		{Path: "/blast/db/README", Version: 2,
+			ModTime: "2017-06-01T10:00:00Z"},
+		{Path: "/blast/db/nt.00.tar.gz", Version: 11,
+			ModTime: "2017-06-02T10:00:00Z", URL: "https://s3/nt?a=1"},
+	}
+	cases := []struct {
+		url         string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"/directory?format=csv", "", "text/csv; charset=utf-8",
+			"Version,ModTime,Path,URL\n" +
+				"2,2017-06-01T10:00:00Z,/blast/db/README,\n" +
+				"11,2017-06-02T10:00:00Z,/blast/db/nt.00.tar.gz," +
+				"https://s3/nt?a=1\n"},
+		{"/directory", "text/tab-separated-values",
+			"text/tab-separated-values; charset=utf-8",
+			"Version\tModTime\tPath\tURL\n" +
+				"2\t2017-06-01T10:00:00Z\t/blast/db/README\t\n" +
+				"11\t2017-06-02T10:00:00Z\t/blast/db/nt.00.tar.gz\t" +
+				"https://s3/nt?a=1\n"},
+		{"/directory", "application/json;q=0.5, application/x-ndjson",
+			"application/x-ndjson",
+			`{"Path":"/blast/db/README","Version":2,` +
+				`"ModTime":"2017-06-01T10:00:00Z"}` + "\n" +
+				`{"Path":"/blast/db/nt.00.tar.gz","Version":11,` +
+				`"ModTime":"2017-06-02T10:00:00Z","URL":"https://s3/nt?a=1"}` +
+				"\n"},
+		{"/directory?format=text", "application/json",
+			"text/plain; charset=utf-8",
+			"2   2017-06-01T10:00:00Z  /blast/db/README\n" +
+				"11  2017-06-02T10:00:00Z  /blast/db/nt.00.tar.gz  " +
+				"https://s3/nt?a=1\n"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header.Set("Accept", c.accept)
+		ac.Output(w, r, listing)
+		assert.Equal(t, c.contentType, w.Header().Get("Content-Type"))
+		assert.Equal(t, c.body, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/directory?format=xml", nil)
+	ac.Output(w, r, listing)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_format")
+
+	// Results that aren't tabular stay JSON
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/readyz?format=csv", nil)
+	ac.Output(w, r, map[string]string{"Status": "ok"})
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
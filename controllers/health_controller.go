@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds how long all readiness checks may take together
+const readyTimeout = 2 * time.Second
+
+// HealthController is for handling liveness and readiness probes
+type HealthController struct {
+	ApplicationController
+	ctx *utils.Context
+}
+
+// NewHealthController returns a new controller instance
+func NewHealthController(ctx *utils.Context) *HealthController {
+	return &HealthController{
+		ctx: ctx,
+	}
+}
+
+// Register registers the health endpoints with the router
+func (hc *HealthController) Register(router *mux.Router) {
+	router.HandleFunc("/healthz", hc.Live)
+	router.HandleFunc("/readyz", hc.Ready)
+}
+
+// Docs describes the health endpoints
+func (hc *HealthController) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/healthz", Summary: "Check that the process is up"},
+		{Path: "/readyz",
+			Summary:  "Check that the database and bucket are reachable",
+			Response: models.Readiness{}},
+	}
+}
+
+// Live handles liveness probes. It only reports that the process is up.
+func (hc *HealthController) Live(w http.ResponseWriter,
+	r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, "ok")
+}
+
+// Ready handles readiness probes. It checks the database, the entries
+// table and the bucket, and responds 503 if any of them fail.
+func (hc *HealthController) Ready(w http.ResponseWriter,
+	r *http.Request) {
+	health := models.NewHealth(hc.ctx.ForRequest(r))
+	result := health.Ready(readyTimeout)
+	code := http.StatusOK
+	if result.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	hc.OutputCode(w, r, code, result)
+}
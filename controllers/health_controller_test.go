@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLive(t *testing.T) {
+	ctx := utils.NewContext()
+	hc := NewHealthController(ctx)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/healthz", nil)
+	hc.Live(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+func TestReadyUnconfigured(t *testing.T) {
+	ctx := utils.NewContext()
+	hc := NewHealthController(ctx)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/readyz", nil)
+	hc.Ready(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"database":{"Status":"error"`)
+	assert.Contains(t, w.Body.String(), `"bucket":{"Status":"error"`)
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"time"
+)
+
+// requestInfoKey is the request context key for the access log details
+const requestInfoKey contextKey = "request-info"
+
+// maxRequestIDLen bounds client-supplied request IDs
+const maxRequestIDLen = 128
+
+// Details about a request that handlers further down the chain fill in for
+// the access log
+type requestInfo struct {
+	route     string
+	principal string
+}
+
+// RequestLogger returns middleware that tags each request with an ID and
+// writes an access log record when it completes. The ID is taken from the
+// X-Request-ID header if the client sent a usable one, and is echoed back
+// in the response.
+func RequestLogger(ctx *utils.Context) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			start := time.Now()
+			id := r.Header.Get("X-Request-ID")
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set("X-Request-ID", id)
+
+			logger := ctx.Log.With("request_id", id)
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				logger = logger.With("trace_id", sc.TraceID().String())
+			}
+			info := &requestInfo{}
+			reqCtx := utils.WithRequestID(r.Context(), id)
+			reqCtx = utils.WithLogger(reqCtx, logger)
+			reqCtx = context.WithValue(reqCtx, requestInfoKey, info)
+			rec := &statusRecorder{ResponseWriter: w, log: logger}
+			next.ServeHTTP(rec, r.WithContext(reqCtx))
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			logger.Info("Request handled.",
+				"method", r.Method,
+				"route", info.route,
+				"path", r.URL.Path,
+				"params", r.URL.RawQuery,
+				"status", rec.status,
+				"bytes", rec.bytes,
+				"duration_ms", time.Since(start).Seconds()*1000,
+				"principal", info.principal,
+				"remote", r.RemoteAddr)
+		})
+	}
+}
+
+// RecordRoute is router middleware that notes the matched route template
+// for the access log and the request's span
+func RecordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if info := getRequestInfo(r); info != nil {
+			info.route = route
+		}
+		if route != "" {
+			// Name the request's span after the route rather than the
+			// raw path, which would make too many distinct span names
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Gets the access log details for a request, if it has any.
+func getRequestInfo(r *http.Request) *requestInfo {
+	res, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return res
+}
+
+// Checks that a client-supplied request ID is short and printable so it
+// can't corrupt log records.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Generates a random request ID.
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// statusRecorder wraps a ResponseWriter to record the status code and
+// number of bytes written. It also carries the request logger.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	log    *slog.Logger
+}
+
+// Gets the request logger for a response writer from RequestLogger, for
+// code that has the writer but not the request. Uses fallback otherwise.
+func writerLogger(w http.ResponseWriter, fallback *slog.Logger) *slog.Logger {
+	if rec, ok := w.(*statusRecorder); ok && rec.log != nil {
+		return rec.log
+	}
+	return fallback
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes through so streamed responses still work
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestLogger(t *testing.T) {
+	ctx := utils.NewContext()
+	ctx.Config.Auth.Tokens = map[string]string{"abc123": "alice"}
+	buf := &bytes.Buffer{}
+	ctx.Log = utils.NewLogger(utils.LogConfig{Level: "info",
+		Format: "json"}, buf)
+	router := mux.NewRouter()
+	router.Use(RecordRoute, Authenticate(ctx))
+	router.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		utils.LoggerFrom(r.Context(), nil).Info("inside")
+		w.Write([]byte("hello"))
+	})
+	handler := RequestLogger(ctx)(router)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/file?path-name=README", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	r.Header.Set("Authorization", "Bearer abc123")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+	assert.Contains(t, buf.String(), `"msg":"inside","request_id":"req-42"`)
+	assert.Contains(t, buf.String(), `"route":"/file"`)
+	assert.Contains(t, buf.String(), `"params":"path-name=README"`)
+	assert.Contains(t, buf.String(), `"status":200,"bytes":5`)
+	assert.Contains(t, buf.String(), `"principal":"alice"`)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/file", nil)
+	r.Header.Set("X-Request-ID", "bad id\n")
+	handler.ServeHTTP(w, r)
+	assert.Len(t, w.Header().Get("X-Request-ID"), 32)
+}
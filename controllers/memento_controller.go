@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ncbiOrigin is where the mirrored files originally live
+const ncbiOrigin = "https://ftp.ncbi.nlm.nih.gov"
+
+// linkFormat is the media type of TimeMaps
+const linkFormat = "application/link-format"
+
+// MementoController implements the Memento protocol (RFC 7089) for the
+// mirror. Each file version is a memento at /memento/<version>/<path>,
+// /timegate/<path> picks one by Accept-Datetime, and /timemap/<path>
+// lists them all. The original resource is the file on NCBI's server.
+type MementoController struct {
+	ApplicationController
+	ctx *utils.Context
+}
+
+// NewMementoController returns a new controller instance
+func NewMementoController(ctx *utils.Context) *MementoController {
+	return &MementoController{
+		ctx: ctx,
+	}
+}
+
+// Register registers the Memento endpoints with the router
+func (mc *MementoController) Register(router *mux.Router) {
+	router.PathPrefix("/timegate/").HandlerFunc(mc.TimeGate)
+	router.PathPrefix("/timemap/").HandlerFunc(mc.TimeMap)
+	router.PathPrefix("/memento/").HandlerFunc(mc.Memento)
+}
+
+// Docs describes the Memento endpoints
+func (mc *MementoController) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/timegate/", Summary: "Memento TimeGate for a file, e.g. " +
+			"/timegate/blast/db/README. Redirects to the version at the " +
+			"Accept-Datetime header, or the latest version."},
+		{Path: "/timemap/", Summary: "Memento TimeMap in " + linkFormat +
+			" listing every version of a file, e.g. " +
+			"/timemap/blast/db/README."},
+		{Path: "/memento/", Summary: "Contents of a file version as a " +
+			"memento, e.g. /memento/2/blast/db/README. Supports Range."},
+	}
+}
+
+// TimeGate handles TimeGate requests. The redirect itself isn't a
+// memento, so as RFC 7089 requires it has no Memento-Datetime header;
+// the memento it points to does.
+func (mc *MementoController) TimeGate(w http.ResponseWriter,
+	r *http.Request) {
+	pathName := strings.TrimPrefix(r.URL.Path, "/timegate")
+	inputTime, _ := utils.ParsePointInTime("latest")
+	if accept := r.Header.Get("Accept-Datetime"); accept != "" {
+		at, parseErr := http.ParseTime(accept)
+		if parseErr != nil {
+			mc.SendError(w, utils.InvalidArgument("invalid_accept_datetime",
+				"Invalid Accept-Datetime "+accept+". Use a date like "+
+					"Thu, 01 Jun 2017 00:00:00 GMT.", parseErr))
+			return
+		}
+		inputTime = at.UTC().Format(utils.TimeLayout)
+	}
+	file := models.NewFile(mc.ctx.ForRequest(r))
+	md, err := file.MetadataAtTime(r.Context(), pathName, inputTime)
+	version := md.Version
+	if utils.KindOf(err) == utils.KindNotFound {
+		// Before the first version, so go to the first version
+		history, histErr := file.GetHistory(r.Context(), pathName)
+		if histErr != nil {
+			err = histErr
+		} else if len(history) > 0 {
+			version = history[len(history)-1].Version
+			err = nil
+		}
+	}
+	if err != nil {
+		mc.SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Vary", "accept-datetime")
+	w.Header().Set("Link", strings.Join(resourceLinks(pathName), ", "))
+	http.Redirect(w, r, mementoHref(version, pathName), http.StatusFound)
+}
+
+// TimeMap handles TimeMap requests.
+func (mc *MementoController) TimeMap(w http.ResponseWriter,
+	r *http.Request) {
+	pathName := strings.TrimPrefix(r.URL.Path, "/timemap")
+	file := models.NewFile(mc.ctx.ForRequest(r))
+	history, err := file.GetHistory(r.Context(), pathName)
+	if err == nil && len(history) == 0 {
+		err = utils.NotFound("file_not_found", "No versions of "+pathName+
+			".", nil)
+	}
+	if err != nil {
+		mc.SendError(w, err)
+		return
+	}
+
+	links := resourceLinks(pathName)
+	links[2] = "<" + davHref("/timemap", pathName) + `>; rel="self"; ` +
+		`type="` + linkFormat + `"`
+	if from, ok := history[len(history)-1].Modified(); ok {
+		links[2] += `; from="` + from.UTC().Format(http.TimeFormat) + `"`
+	}
+	if until, ok := history[0].Modified(); ok {
+		links[2] += `; until="` + until.UTC().Format(http.TimeFormat) + `"`
+	}
+	// Oldest first
+	for i := len(history) - 1; i >= 0; i-- {
+		rel := "memento"
+		switch {
+		case len(history) == 1:
+			rel = "first last memento"
+		case i == len(history)-1:
+			rel = "first memento"
+		case i == 0:
+			rel = "last memento"
+		}
+		links = append(links, mementoLink(history[i], rel))
+	}
+	w.Header().Set("Content-Type", linkFormat)
+	fmt.Fprint(w, strings.Join(links, ",\n")+"\n")
+}
+
+// Memento handles requests for the contents of a file version, with
+// Memento-Datetime and links to the neighboring versions.
+func (mc *MementoController) Memento(w http.ResponseWriter,
+	r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/memento/"),
+		"/", 2)
+	version, err := strconv.Atoi(parts[0])
+	if err != nil || version < 1 || len(parts) < 2 {
+		mc.SendError(w, utils.InvalidArgument("invalid_memento",
+			"Use a path like /memento/2/blast/db/README.", err))
+		return
+	}
+	pathName := "/" + parts[1]
+	file := models.NewFile(mc.ctx.ForRequest(r))
+	md, err := file.MetadataForVersion(r.Context(), pathName, version)
+	if err != nil {
+		mc.SendError(w, err)
+		return
+	}
+	versions, err := file.GetAdjacent(r.Context(), pathName, version)
+	if err != nil {
+		mc.SendError(w, err)
+		return
+	}
+
+	if modTime, ok := md.Modified(); ok {
+		w.Header().Set("Memento-Datetime",
+			modTime.UTC().Format(http.TimeFormat))
+	}
+	setVersionLinks(w, pathName, versions, version)
+	serveObject(w, r, file, md, mc.SendError)
+}
+
+// Sets the Link header for a version of a file: the original resource,
+// TimeGate and TimeMap, and the previous and next versions. versions is
+// newest first, as GetAdjacent returns it.
+func setVersionLinks(w http.ResponseWriter, pathName string,
+	versions []models.Entry, version int) {
+	links := resourceLinks(pathName)
+	for i, entry := range versions {
+		if entry.Version != version {
+			continue
+		}
+		if i+1 < len(versions) {
+			links = append(links, mementoLink(versions[i+1], "prev memento"))
+		}
+		if i > 0 {
+			links = append(links, mementoLink(versions[i-1], "next memento"))
+		}
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// Makes links to the original resource, TimeGate and TimeMap of a file.
+func resourceLinks(pathName string) []string {
+	return []string{
+		"<" + ncbiOrigin + davHref("", pathName) + `>; rel="original"`,
+		"<" + davHref("/timegate", pathName) + `>; rel="timegate"`,
+		"<" + davHref("/timemap", pathName) + `>; rel="timemap"; ` +
+			`type="` + linkFormat + `"`,
+	}
+}
+
+// Makes a link to a file version with its datetime.
+func mementoLink(entry models.Entry, rel string) string {
+	res := "<" + mementoHref(entry.Version, entry.Path) + `>; rel="` + rel +
+		`"`
+	if modTime, ok := entry.Modified(); ok {
+		res += `; datetime="` + modTime.UTC().Format(http.TimeFormat) + `"`
+	}
+	return res
+}
+
+// Makes the URL path of a file version.
+func mementoHref(version int, pathName string) string {
+	return davHref("/memento/"+strconv.Itoa(version), pathName)
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMemento(t *testing.T) {
+	mc := NewMementoController(newTestDav(t).ctx)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/timegate/blast/db/README", nil)
+	r.Header.Set("Accept-Datetime", "Thu, 01 Jun 2017 00:00:00 GMT")
+	mc.TimeGate(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/memento/1/blast/db/README", w.Header().Get("Location"))
+	assert.Equal(t, "accept-datetime", w.Header().Get("Vary"))
+	assert.Contains(t, w.Header().Get("Link"),
+		`<https://ftp.ncbi.nlm.nih.gov/blast/db/README>; rel="original"`)
+
+	// Before the first version
+	w = httptest.NewRecorder()
+	r.Header.Set("Accept-Datetime", "Fri, 01 Jan 2016 00:00:00 GMT")
+	mc.TimeGate(w, r)
+	assert.Equal(t, "/memento/1/blast/db/README", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/memento/1/blast/db/README", nil)
+	mc.Memento(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first version", w.Body.String())
+	assert.Equal(t, "Sun, 01 Jan 2017 00:00:00 GMT",
+		w.Header().Get("Memento-Datetime"))
+	assert.Contains(t, w.Header().Get("Link"),
+		`</memento/2/blast/db/README>; rel="next memento"; `+
+			`datetime="Sat, 01 Jul 2017 00:00:00 GMT"`)
+	assert.NotContains(t, w.Header().Get("Link"), "prev memento")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/timemap/blast/db/README", nil)
+	mc.TimeMap(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/link-format", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, `</memento/1/blast/db/README>; `+
+		`rel="first memento"; datetime="Sun, 01 Jan 2017 00:00:00 GMT"`)
+	assert.Contains(t, body, `</memento/2/blast/db/README>; `+
+		`rel="last memento"`)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/timemap/nope", nil)
+	mc.TimeMap(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMementoLinksSkipGaps(t *testing.T) {
+	ctx := newTestContext(t, [][]interface{}{
+		{"/README", 1, "2017-01-01T00:00:00", "R-1"},
+		{"/README", 3, "2017-02-01T00:00:00", "R-3"},
+		{"/README", 4, "2017-03-01T00:00:00", "R-4"},
+		{"/README", 7, "2017-04-01T00:00:00", "R-7"},
+	})
+	ctx.Store = mockStore{objects: map[string]string{"/archive/R-4": "4"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/memento/4/README", nil)
+	NewMementoController(ctx).Memento(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	link := w.Header().Get("Link")
+	assert.Contains(t, link, `</memento/3/README>; rel="prev memento"`)
+	assert.Contains(t, link, `</memento/7/README>; rel="next memento"`)
+	assert.NotContains(t, link, "/memento/1/")
+}
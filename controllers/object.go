@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnsatisfiable is returned for a byte range outside the object
+var errUnsatisfiable = errors.New("Range not satisfiable.")
+
+// A byte range of an object, inclusive at both ends
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// The number of bytes in the range.
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+// Formats the range for a Range request header.
+func (br byteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", br.start, br.end)
+}
+
+// Formats the range for a Content-Range response header.
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// Parses a Range header for an object of the given size. Only a single
+// range is supported, so the header is ignored and false returned for
+// several ranges or a malformed value, which means sending the whole
+// object. Returns errUnsatisfiable if the range is outside the object.
+func parseRange(header string, size int64) (byteRange, bool, error) {
+	if !strings.HasPrefix(header, "bytes=") ||
+		strings.Contains(header, ",") {
+		return byteRange{}, false, nil
+	}
+	parts := strings.SplitN(strings.TrimSpace(header[len("bytes="):]), "-", 2)
+	if len(parts) != 2 {
+		return byteRange{}, false, nil
+	}
+	if parts[0] == "" {
+		// Suffix range of the last n bytes
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, false, errUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{size - n, size - 1}, true, nil
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return byteRange{}, false, errUnsatisfiable
+	}
+	return byteRange{start, end}, true, nil
+}
+
+// Picks the content type of a file version. The mirror stores most
+// objects as binary/octet-stream, so the file extension wins.
+func contentType(md models.Metadata, info models.ObjectInfo) string {
+	if res := mime.TypeByExtension(path.Ext(md.Path)); res != "" {
+		return res
+	}
+	if info.ContentType != "" {
+		return info.ContentType
+	}
+	return "application/octet-stream"
+}
+
+// Sends a stored file version to the client, or just its headers for a
+// HEAD request. A single byte range is honored with a 206 response, and a
+// range outside the object gets a 416. Errors before anything is sent are
+// passed to sendError, so callers can format them for their protocol.
+func serveObject(w http.ResponseWriter, r *http.Request, file *models.File,
+	md models.Metadata, sendError func(http.ResponseWriter, error)) {
+	info, err := file.Stat(r.Context(), md)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Type", contentType(md, info))
+	if info.ETag != "" {
+		header.Set("ETag", info.ETag)
+	}
+	if modTime, ok := md.Modified(); ok {
+		header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	br, partial, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	status := http.StatusOK
+	length := info.Size
+	rangeHeader := ""
+	if partial {
+		status = http.StatusPartialContent
+		length = br.length()
+		rangeHeader = br.header()
+		header.Set("Content-Range", br.contentRange(info.Size))
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	out, err := file.Open(r.Context(), md, rangeHeader)
+	if err != nil {
+		header.Del("Content-Range")
+		header.Del("Content-Length")
+		sendError(w, err)
+		return
+	}
+	defer out.Body.Close()
+	w.WriteHeader(status)
+	if _, err = io.Copy(w, out.Body); err != nil {
+		utils.LoggerFrom(r.Context(), slog.Default()).Warn(
+			"Couldn't send object.", "path", md.Path, "error", err)
+	}
+}
+
+// Gets the request's context with the client's choices for download
+// URLs: expires-in, disposition and versioned-name.
+func urlContext(base *utils.Context, r *http.Request) (*utils.Context,
+	error) {
+	ctx := base.ForRequest(r)
+	query := r.URL.Query()
+	if value := query.Get("expires-in"); value != "" {
+		maxTTL := ctx.Config.Signing.MaxTTL.Duration
+		res, err := time.ParseDuration(value)
+		if err != nil || res < time.Second || res > maxTTL {
+			return nil, utils.InvalidArgument("invalid_expires_in",
+				fmt.Sprintf("Invalid expires-in %s. Use a duration "+
+					"between 1s and %s.", value, maxTTL), err)
+		}
+		ctx.URLOptions.ExpiresIn = res
+	}
+	switch value := query.Get("disposition"); value {
+	case "", "attachment":
+	case "inline":
+		ctx.URLOptions.Inline = true
+	default:
+		return nil, utils.InvalidArgument("invalid_disposition",
+			"Invalid disposition "+value+". Use attachment or inline.", nil)
+	}
+	if value := query.Get("versioned-name"); value != "" {
+		res, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, utils.InvalidArgument("invalid_versioned_name",
+				"Invalid versioned-name "+value+".", err)
+		}
+		ctx.URLOptions.VersionedName = res
+	}
+	return ctx, nil
+}
+
+// Gets how long clients may cache a response with download URLs, which
+// must be less than the URLs' lifetime.
+func cacheAge(ctx *utils.Context) time.Duration {
+	maxAge := ctx.Config.Cache.MaxAge.Duration
+	if ctx.URLTTL() <= maxAge {
+		return 0
+	}
+	return maxAge
+}
@@ -0,0 +1,390 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// RouteDoc describes a route for the OpenAPI document. Response is a value
+// whose type defines the success response schema, or nil for plain text.
+// Method defaults to GET, and Body is a value whose type defines the JSON
+// request body, if any. A path served with several methods has a RouteDoc
+// for each.
+type RouteDoc struct {
+	Path     string
+	Summary  string
+	Method   string
+	Params   []ParamDoc
+	Body     interface{}
+	Response interface{}
+}
+
+// ParamDoc describes a query parameter of a route
+type ParamDoc struct {
+	Name        string
+	Description string
+	Required    bool
+	// Type is a JSON schema type. Defaults to string.
+	Type string
+	Enum []string
+}
+
+// Documented is implemented by controllers that describe their routes
+type Documented interface {
+	Docs() []RouteDoc
+}
+
+// Common parameters shared by several routes
+var (
+	pathNameParam = ParamDoc{Name: "path-name", Required: true,
+		Description: "Path of the file or directory in the mirror, " +
+			"e.g. /blast/db/README"}
+	inputTimeParam = ParamDoc{Name: "input-time", Required: true,
+		Description: "Point in time to resolve, e.g. 2017-06-01T00:00:00"}
+	outputParam = ParamDoc{Name: "output", Enum: []string{"with-URLs"},
+		Description: "Set to with-URLs to include download URLs"}
+	formatParam = ParamDoc{Name: "format",
+		Enum: []string{formatJSON, formatNDJSON, formatCSV, formatTSV,
+			formatText},
+		Description: "Output format. Overrides the Accept header."}
+	expiresInParam = ParamDoc{Name: "expires-in",
+		Description: "How long download URLs stay valid, e.g. 6h, up to " +
+			"the server's limit"}
+	dispositionParam = ParamDoc{Name: "disposition",
+		Enum: []string{"attachment", "inline"},
+		Description: "Whether browsers save the file or show it. " +
+			"Defaults to attachment."}
+	versionedNameParam = ParamDoc{Name: "versioned-name", Type: "boolean",
+		Description: "Put the version number in the download filename"}
+	includeYankedParam = ParamDoc{Name: "include-yanked", Type: "boolean",
+		Description: "Resolve points in time to yanked versions too"}
+)
+
+// OpenAPIController serves an OpenAPI 3 description of the server. The
+// paths come from walking the router, so every registered route appears,
+// and the schemas are reflected from the response types.
+type OpenAPIController struct {
+	ApplicationController
+	ctx    *utils.Context
+	router *mux.Router
+	docs   map[string][]RouteDoc
+}
+
+// NewOpenAPIController returns a new controller instance describing the
+// routes of the given controllers
+func NewOpenAPIController(ctx *utils.Context, router *mux.Router,
+	controllers ...Documented) *OpenAPIController {
+	oc := &OpenAPIController{
+		ctx:    ctx,
+		router: router,
+		docs:   map[string][]RouteDoc{},
+	}
+	controllers = append(controllers, oc)
+	for _, c := range controllers {
+		for _, doc := range c.Docs() {
+			oc.docs[doc.Path] = append(oc.docs[doc.Path], doc)
+		}
+	}
+	return oc
+}
+
+// Register registers the OpenAPI endpoint with the router
+func (oc *OpenAPIController) Register(router *mux.Router) {
+	router.HandleFunc("/openapi.json", oc.Show)
+}
+
+// Docs describes the OpenAPI endpoint
+func (oc *OpenAPIController) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/openapi.json", Summary: "This OpenAPI description",
+			Response: map[string]interface{}{}},
+	}
+}
+
+// Show handles requests for the OpenAPI document
+func (oc *OpenAPIController) Show(w http.ResponseWriter,
+	r *http.Request) {
+	doc, err := oc.Document()
+	oc.DefaultResponse(w, r, doc, err)
+}
+
+// Undocumented lists the routes on the router that have no RouteDoc
+func (oc *OpenAPIController) Undocumented() ([]string, error) {
+	res := []string{}
+	err := oc.walk(func(path string) {
+		if _, ok := oc.docs[path]; !ok {
+			res = append(res, path)
+		}
+	})
+	return res, err
+}
+
+// Calls fn with the path template of each route on the router.
+func (oc *OpenAPIController) walk(fn func(path string)) error {
+	return oc.router.Walk(func(route *mux.Route, router *mux.Router,
+		ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			// Routes without paths, e.g. matchers only
+			return nil
+		}
+		fn(path)
+		return nil
+	})
+}
+
+// Document builds the OpenAPI document from the routes on the router.
+// Routes without a RouteDoc are left out.
+func (oc *OpenAPIController) Document() (map[string]interface{}, error) {
+	schemas := map[string]interface{}{}
+	errorSchema := schemaFor(reflect.TypeOf(ErrorResponse{}), schemas)
+	paths := map[string]interface{}{}
+	err := oc.walk(func(path string) {
+		docs, ok := oc.docs[path]
+		if !ok {
+			return
+		}
+		operations := map[string]interface{}{}
+		for _, doc := range docs {
+			method := http.MethodGet
+			if doc.Method != "" {
+				method = doc.Method
+			}
+			op := operation(doc, errorSchema, schemas)
+			if len(docs) > 1 && method != http.MethodGet {
+				// Operation IDs must be unique
+				id := op["operationId"].(string)
+				op["operationId"] = strings.ToLower(method) +
+					strings.ToUpper(id[:1]) + id[1:]
+			}
+			operations[strings.ToLower(method)] = op
+		}
+		paths[path] = operations
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title": "NCBI data tool",
+			"description": "Access to current and past versions of " +
+				"files mirrored from the NCBI FTP server.",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+		},
+	}
+	return res, nil
+}
+
+// Builds the OpenAPI operation object for a route.
+func operation(doc RouteDoc, errorSchema map[string]interface{},
+	schemas map[string]interface{}) map[string]interface{} {
+	_, _, tabular := tableRows(doc.Response)
+	docParams := doc.Params
+	if tabular {
+		docParams = append(docParams, formatParam)
+	}
+	params := []interface{}{}
+	for _, p := range docParams {
+		schema := map[string]interface{}{"type": "string"}
+		if p.Type != "" {
+			schema["type"] = p.Type
+		}
+		if len(p.Enum) > 0 {
+			schema["enum"] = p.Enum
+		}
+		params = append(params, map[string]interface{}{
+			"name":        p.Name,
+			"in":          "query",
+			"description": p.Description,
+			"required":    p.Required,
+			"schema":      schema,
+		})
+	}
+
+	success := map[string]interface{}{"description": "Success"}
+	if doc.Response == nil {
+		success["content"] = map[string]interface{}{
+			"text/plain": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"},
+			},
+		}
+	} else {
+		content := jsonContent(
+			schemaFor(reflect.TypeOf(doc.Response), schemas))
+		if tabular {
+			for _, format := range []string{formatNDJSON, formatCSV,
+				formatTSV, formatText} {
+				mediaType := strings.Split(formatContentTypes[format], ";")[0]
+				content[mediaType] = map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"},
+				}
+			}
+		}
+		success["content"] = content
+	}
+	responses := map[string]interface{}{"200": success}
+	for code, description := range errorResponses {
+		responses[code] = map[string]interface{}{
+			"description": description,
+			"content":     jsonContent(errorSchema),
+		}
+	}
+
+	res := map[string]interface{}{
+		"summary":     doc.Summary,
+		"operationId": operationID(doc.Path),
+		"parameters":  params,
+		"responses":   responses,
+	}
+	if doc.Body != nil {
+		res["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": jsonContent(
+				schemaFor(reflect.TypeOf(doc.Body), schemas)),
+		}
+	}
+	return res
+}
+
+// Error responses any route may return
+var errorResponses = map[string]string{
+	"400": "Bad request",
+	"401": "Missing or invalid API token",
+	"403": "Not allowed for this principal",
+	"404": "No such file, version or directory",
+	"409": "Version must be restored from cold storage first",
+	"500": "Server error",
+	"503": "Database or object store unavailable",
+	"504": "Query took longer than the route's timeout",
+}
+
+// Wraps a schema as JSON response content.
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// Makes an operation ID like "directoryAtTime" from a path.
+func operationID(path string) string {
+	res := ""
+	for _, part := range strings.FieldsFunc(path, func(c rune) bool {
+		return c == '/' || c == '-' || c == '.'
+	}) {
+		if res == "" {
+			res = part
+		} else {
+			res += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return res
+}
+
+// Builds a JSON schema for a Go type the way encoding/json would marshal
+// it. Named struct types are added to schemas and referenced.
+func schemaFor(t reflect.Type,
+	schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaFor(t.Elem(), schemas),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaFor(t.Elem(), schemas),
+		}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Reserve the name first in case the type refers to itself
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{
+			"$ref": "#/components/schemas/" + t.Name(),
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// Builds the object schema for a struct type's JSON fields.
+func structSchema(t reflect.Type,
+	schemas map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		omitEmpty := false
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				omitEmpty = omitEmpty || opt == "omitempty"
+			}
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embedded := structSchema(field.Type, schemas)
+			for k, v := range embedded["properties"].(map[string]interface{}) {
+				props[k] = v
+			}
+			continue
+		}
+		props[name] = schemaFor(field.Type, schemas)
+		if !omitEmpty {
+			required = append(required, name)
+		}
+	}
+	res := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		res["required"] = required
+	}
+	return res
+}
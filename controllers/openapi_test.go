@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/utils"
+	"net/http/httptest"
+	"testing"
+)
+
+// Builds a router with the same controllers as the server.
+func newTestRouter(ctx *utils.Context) (*mux.Router, *OpenAPIController) {
+	router := mux.NewRouter()
+	fc := NewFileController(ctx)
+	fc.Register(router)
+	dc := NewDirectoryController(ctx)
+	dc.Register(router)
+	hc := NewHealthController(ctx)
+	hc.Register(router)
+	davc := NewDavController(ctx)
+	davc.Register(router)
+	sc := NewS3Controller(ctx)
+	sc.Register(router)
+	bc := NewBrowseController(ctx)
+	bc.Register(router)
+	mc := NewMementoController(ctx)
+	mc.Register(router)
+	adc := NewAdminController(ctx)
+	adc.Register(router)
+	pc := NewPinController(ctx)
+	pc.Register(router)
+	oc := NewOpenAPIController(ctx, router, fc, dc, hc, davc, sc, bc, mc,
+		adc, pc)
+	oc.Register(router)
+	return router, oc
+}
+
+func TestEveryRouteDocumented(t *testing.T) {
+	_, oc := newTestRouter(utils.NewContext())
+	undocumented, err := oc.Undocumented()
+	assert.Nil(t, err)
+	assert.Empty(t, undocumented)
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	router, _ := newTestRouter(utils.NewContext())
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/openapi.json", nil)
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	var doc struct {
+		Paths      map[string]interface{}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{}
+				Required   []string
+			}
+		}
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	for _, path := range []string{"/file", "/file/history", "/file/at-time",
+		"/directory", "/directory/compare", "/directory/at-time"} {
+		assert.Contains(t, doc.Paths, path)
+	}
+	entry := doc.Components.Schemas["Entry"]
+	assert.Len(t, entry.Properties, 7)
+	assert.Contains(t, entry.Properties, "URL")
+	assert.Empty(t, entry.Required)
+	assert.Contains(t, doc.Components.Schemas, "CompareResponse")
+	assert.Equal(t, []string{"Code", "Error", "ErrorCode"},
+		doc.Components.Schemas["ErrorResponse"].Required)
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"strconv"
+)
+
+// PinController is for handling pins, which keep file versions from being
+// deleted
+type PinController struct {
+	ApplicationController
+	ctx *utils.Context
+}
+
+// NewPinController returns a new controller instance
+func NewPinController(ctx *utils.Context) *PinController {
+	return &PinController{
+		ctx: ctx,
+	}
+}
+
+// Register registers the pin endpoints with the router
+func (pc *PinController) Register(router *mux.Router) {
+	router.HandleFunc("/pins", pc.List).Methods(http.MethodGet)
+	router.HandleFunc("/pins", pc.Add).Methods(http.MethodPost)
+	router.HandleFunc("/pins", pc.Remove).Methods(http.MethodDelete)
+}
+
+// Docs describes the pin endpoints
+func (pc *PinController) Docs() []RouteDoc {
+	holderParam := ParamDoc{Name: "holder",
+		Description: "Who holds the pin. Defaults to the caller; only " +
+			"admins may act for others. Needs an API token."}
+	versionParam := ParamDoc{Name: "version-num", Type: "integer",
+		Required: true, Description: "Version to pin"}
+	return []RouteDoc{
+		{Path: "/pins", Summary: "List the pins that haven't expired",
+			Params: []ParamDoc{{Name: "path-name",
+				Description: "Only list pins of this file"}},
+			Response: []models.Pin{}},
+		{Path: "/pins", Method: http.MethodPost,
+			Summary: "Pin a file version so it's never deleted. Pinning " +
+				"again replaces the holder's reason and expiry.",
+			Params: []ParamDoc{pathNameParam, versionParam,
+				{Name: "reason", Required: true,
+					Description: "Why the version must be kept"},
+				{Name: "expires",
+					Description: "When the pin expires, e.g. 2030-01-01. " +
+						"Defaults to never."},
+				holderParam},
+			Response: models.Pin{}},
+		{Path: "/pins", Method: http.MethodDelete,
+			Summary: "Remove a pin from a file version",
+			Params:  []ParamDoc{pathNameParam, versionParam, holderParam}},
+	}
+}
+
+// List handles requests for listing pins.
+func (pc *PinController) List(w http.ResponseWriter, r *http.Request) {
+	pins := models.NewPins(pc.ctx.ForRequest(r))
+	result, err := pins.List(r.URL.Query().Get("path-name"))
+	pc.DefaultResponse(w, r, result, err)
+}
+
+// Add handles requests for pinning a file version.
+func (pc *PinController) Add(w http.ResponseWriter, r *http.Request) {
+	err := pc.RequireParams(r, "path-name", "version-num", "reason")
+	if err != nil {
+		pc.SendError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	pin := models.Pin{
+		Path:    query.Get("path-name"),
+		Reason:  query.Get("reason"),
+		Expires: query.Get("expires"),
+	}
+	if pin.Version, err = pc.version(r); err == nil {
+		pin.Holder, err = pc.holder(r)
+	}
+	if err != nil {
+		pc.SendError(w, err)
+		return
+	}
+	result, err := models.NewPins(pc.ctx.ForRequest(r)).Add(pin)
+	if err != nil {
+		pc.SendError(w, err)
+		return
+	}
+	pc.ctx.Log.Info("Pinned version.", "path", result.Path,
+		"version", result.Version, "holder", result.Holder,
+		"principal", Principal(r))
+	pc.Output(w, r, result)
+}
+
+// Remove handles requests for removing a pin.
+func (pc *PinController) Remove(w http.ResponseWriter, r *http.Request) {
+	err := pc.RequireParams(r, "path-name", "version-num")
+	if err != nil {
+		pc.SendError(w, err)
+		return
+	}
+	pathName := r.URL.Query().Get("path-name")
+	version, err := pc.version(r)
+	var holder string
+	if err == nil {
+		holder, err = pc.holder(r)
+	}
+	if err == nil {
+		err = models.NewPins(pc.ctx.ForRequest(r)).Remove(pathName, version,
+			holder)
+	}
+	if err != nil {
+		pc.SendError(w, err)
+		return
+	}
+	pc.ctx.Log.Info("Unpinned version.", "path", pathName,
+		"version", version, "holder", holder, "principal", Principal(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Gets the version-num of a request.
+func (pc *PinController) version(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("version-num")
+	res, err := strconv.Atoi(value)
+	if err != nil || res < 1 {
+		return 0, utils.InvalidArgument("invalid_version",
+			"Invalid version-num "+value+".", err)
+	}
+	return res, nil
+}
+
+// Gets the holder a request acts for: the caller, or another holder if
+// the caller is an admin. Requests without a token can't pin.
+func (pc *PinController) holder(r *http.Request) (string, error) {
+	principal, err := requirePrincipal(r)
+	if err != nil {
+		return "", err
+	}
+	holder := r.URL.Query().Get("holder")
+	if holder == "" || holder == principal {
+		return principal, nil
+	}
+	if err := requireAdmin(pc.ctx, r); err != nil {
+		return "", err
+	}
+	return holder, nil
+}
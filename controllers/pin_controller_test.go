@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"ncbi-tool-server/models"
+	"net/http"
+	"testing"
+)
+
+func TestPins(t *testing.T) {
+	ctx := newTestDav(t).ctx
+	ctx.Config.Auth.Admins = []string{"admin"}
+	router := mux.NewRouter()
+	NewPinController(ctx).Register(router)
+	NewFileController(ctx).Register(router)
+
+	w := requestAs(router, "alice", "POST", "/pins?path-name=/blast/db/"+
+		"README&version-num=1&reason=paper&expires=2999-01-01")
+	assert.Equal(t, http.StatusOK, w.Code)
+	pin := models.Pin{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &pin))
+	assert.Equal(t, "alice", pin.Holder)
+	assert.Equal(t, "2999-01-01T00:00:00", pin.Expires)
+
+	for _, query := range []string{"version-num=3&reason=paper",
+		"version-num=1&reason=paper&expires=2001-01-01",
+		"version-num=1&reason=paper&holder=carol"} {
+		w = requestAs(router, "bob", "POST", "/pins?path-name=/blast/db/"+
+			"README&"+query)
+		assert.NotEqual(t, http.StatusOK, w.Code, query)
+	}
+	w = requestAs(router, "bob", "POST", "/pins?path-name=/blast/db/"+
+		"README&version-num=3&reason=paper")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = requestAs(router, "bob", "GET",
+		"/file/history?path-name=/blast/db/README")
+	assert.Equal(t, http.StatusOK, w.Code)
+	history := []models.Entry{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Len(t, history, 2)
+	assert.Empty(t, history[0].Pins)
+	assert.Len(t, history[1].Pins, 1)
+	assert.Equal(t, "paper", history[1].Pins[0].Reason)
+
+	// Only the holder or an admin can remove a pin, and never anonymously
+	w = requestAs(router, "", "DELETE", "/pins?path-name=/blast/db/"+
+		"README&version-num=1&holder=alice")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = requestAs(router, "", "POST", "/pins?path-name=/blast/db/"+
+		"README&version-num=1&reason=paper&holder=alice")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = requestAs(router, "bob", "DELETE", "/pins?path-name=/blast/db/"+
+		"README&version-num=1&holder=alice")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = requestAs(router, "bob", "DELETE", "/pins?path-name=/blast/db/"+
+		"README&version-num=1")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = requestAs(router, "admin", "DELETE", "/pins?path-name=/blast/db/"+
+		"README&version-num=1&holder=alice")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = requestAs(router, "bob", "GET", "/pins")
+	assert.Equal(t, "[]", w.Body.String())
+}
@@ -0,0 +1,358 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"io"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// s3Bucket is the virtual bucket name, followed by the snapshot time
+	// as in "ncbi@2017-06-01"
+	s3Bucket = "ncbi"
+	// s3MaxKeys is the most keys a listing page may have
+	s3MaxKeys = 1000
+	// s3ListBatch is how many files are read from the Db at a time while
+	// listing
+	s3ListBatch = s3MaxKeys + 1
+	// s3Namespace is the XML namespace of S3 responses
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+// S3Controller serves a minimal read-only S3-compatible API under /s3/.
+// The bucket name picks the snapshot, as in "ncbi@2017-06-01" or
+// "ncbi@latest". Clients that validate bucket names can write
+// "ncbi--2017-06-01" instead. Keys are mirror paths without the leading
+// slash.
+type S3Controller struct {
+	ApplicationController
+	ctx *utils.Context
+}
+
+// NewS3Controller returns a new controller instance
+func NewS3Controller(ctx *utils.Context) *S3Controller {
+	return &S3Controller{
+		ctx: ctx,
+	}
+}
+
+// Register registers the S3 endpoint with the router
+func (sc *S3Controller) Register(router *mux.Router) {
+	router.PathPrefix("/s3/").HandlerFunc(sc.Serve)
+}
+
+// Docs describes the S3 endpoint
+func (sc *S3Controller) Docs() []RouteDoc {
+	return []RouteDoc{
+		{Path: "/s3/", Summary: "Read-only S3-compatible API over " +
+			"snapshots. Use /s3 as the endpoint URL with path-style " +
+			"addressing and a bucket like ncbi@2017-06-01 or " +
+			"ncbi--2017-06-01. Supports ListObjectsV2, HeadObject and " +
+			"GetObject with Range."},
+	}
+}
+
+// S3 error response body
+type s3ErrorBody struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+// ListObjectsV2 response body
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Namespace             string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+// An object in a listing
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+// A common prefix in a listing with a delimiter
+type s3Prefix struct {
+	Prefix string
+}
+
+// Serve handles S3 requests
+func (sc *S3Controller) Serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sc.s3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed",
+			"This API is read-only.")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/s3/"), "/", 2)
+	inputTime, ok := snapshotTime(parts[0])
+	if !ok {
+		sc.s3Error(w, r, http.StatusNotFound, "NoSuchBucket",
+			"Use a bucket like "+s3Bucket+"@2017-06-01.")
+		return
+	}
+	ctx := sc.ctx.ForRequest(r)
+	if len(parts) == 2 && parts[1] != "" {
+		file := models.NewFile(ctx)
+		md, err := file.MetadataAtTime(r.Context(), "/"+parts[1], inputTime)
+		if err != nil {
+			sc.sendError(w, r, err)
+			return
+		}
+		serveObject(w, r, file, md, func(w http.ResponseWriter, err error) {
+			sc.sendError(w, r, err)
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		// HeadBucket
+		w.WriteHeader(http.StatusOK)
+	case query["location"] != nil:
+		sc.writeXML(w, r, struct {
+			XMLName   xml.Name `xml:"LocationConstraint"`
+			Namespace string   `xml:"xmlns,attr"`
+		}{Namespace: s3Namespace})
+	case query.Get("list-type") == "2":
+		sc.listObjects(w, r, ctx, parts[0], inputTime)
+	default:
+		sc.s3Error(w, r, http.StatusNotImplemented, "NotImplemented",
+			"Only ListObjectsV2 is supported for buckets.")
+	}
+}
+
+// Parses a bucket name into the snapshot time.
+func snapshotTime(bucket string) (string, bool) {
+	for _, sep := range []string{"@", "--"} {
+		parts := strings.SplitN(bucket, sep, 2)
+		if len(parts) == 2 && parts[0] == s3Bucket {
+			res, err := utils.ParsePointInTime(parts[1])
+			return res, err == nil
+		}
+	}
+	return "", false
+}
+
+// Handles ListObjectsV2. Keys are listed in order, grouped into common
+// prefixes by the delimiter if one is given. The continuation token is
+// the last key or prefix of the previous page. Files are read from the Db
+// a batch at a time from the token on, skipping past the keys of each
+// common prefix.
+func (sc *S3Controller) listObjects(w http.ResponseWriter, r *http.Request,
+	ctx *utils.Context, bucket string, inputTime string) {
+	query := r.URL.Query()
+	res := s3ListResult{
+		Namespace:         s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           s3MaxKeys,
+	}
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			sc.s3Error(w, r, http.StatusBadRequest, "InvalidArgument",
+				"Invalid max-keys.")
+			return
+		}
+		if n < s3MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+	after := res.StartAfter
+	if res.ContinuationToken != "" {
+		token, err := base64.URLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			sc.s3Error(w, r, http.StatusBadRequest, "InvalidArgument",
+				"Invalid continuation token.")
+			return
+		}
+		after = string(token)
+	}
+
+	dir := models.NewDirectory(ctx)
+	from := "/" + res.Prefix
+	if after > res.Prefix {
+		from = "/" + after
+	}
+	page := []models.Metadata{}
+	last := ""
+	count := 0
+	for done := res.MaxKeys == 0; !done; {
+		batch, err := dir.GetTreePage(r.Context(), "/"+res.Prefix, from,
+			inputTime, s3ListBatch)
+		if err != nil {
+			sc.sendError(w, r, err)
+			return
+		}
+		done = len(batch) < s3ListBatch
+		for _, md := range batch {
+			// The next batch starts with this file, which is skipped
+			from = md.Path
+			key := md.Path[1:]
+			entry := key
+			if res.Delimiter != "" {
+				rest := key[len(res.Prefix):]
+				if i := strings.Index(rest, res.Delimiter); i >= 0 {
+					entry = key[:len(res.Prefix)+i+len(res.Delimiter)]
+				}
+			}
+			if entry > after && entry != last {
+				if count == res.MaxKeys {
+					res.IsTruncated = true
+					done = true
+					break
+				}
+				last = entry
+				count++
+				if entry == key {
+					page = append(page, md)
+				} else {
+					res.CommonPrefixes = append(res.CommonPrefixes,
+						s3Prefix{entry})
+				}
+			}
+			if skip, ok := pastPrefix(entry); ok && entry != key {
+				from = "/" + skip
+				done = false
+				break
+			}
+		}
+	}
+	if res.IsTruncated {
+		res.NextContinuationToken = base64.URLEncoding.EncodeToString(
+			[]byte(last))
+	}
+
+	infos, err := models.NewFile(ctx).StatAll(r.Context(), page)
+	if err != nil {
+		sc.sendError(w, r, err)
+		return
+	}
+	for i, md := range page {
+		if infos[i].Missing {
+			continue
+		}
+		obj := s3Object{
+			Key:          md.Path[1:],
+			ETag:         infos[i].ETag,
+			Size:         infos[i].Size,
+			StorageClass: "STANDARD",
+		}
+		if modTime, ok := md.Modified(); ok {
+			obj.LastModified = modTime.UTC().Format("2006-01-02T15:04:05.000Z")
+		}
+		res.Contents = append(res.Contents, obj)
+	}
+	// Objects missing from the store aren't listed or counted
+	res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	if query.Get("encoding-type") == "url" {
+		res.EncodingType = "url"
+		res.Prefix = url.QueryEscape(res.Prefix)
+		res.Delimiter = url.QueryEscape(res.Delimiter)
+		res.StartAfter = url.QueryEscape(res.StartAfter)
+		for i := range res.Contents {
+			res.Contents[i].Key = url.QueryEscape(res.Contents[i].Key)
+		}
+		for i := range res.CommonPrefixes {
+			res.CommonPrefixes[i].Prefix =
+				url.QueryEscape(res.CommonPrefixes[i].Prefix)
+		}
+	}
+	sc.writeXML(w, r, res)
+}
+
+// Gets the first string after every string that starts with prefix, by
+// incrementing its last byte. Returns false if there is none.
+func pastPrefix(prefix string) (string, bool) {
+	last := prefix[len(prefix)-1]
+	if last == 0xff {
+		return "", false
+	}
+	return prefix[:len(prefix)-1] + string([]byte{last + 1}), true
+}
+
+// Sends a domain error as an S3 error.
+func (sc *S3Controller) sendError(w http.ResponseWriter, r *http.Request,
+	err error) {
+	switch utils.KindOf(err) {
+	case utils.KindNotFound:
+		sc.s3Error(w, r, http.StatusNotFound, "NoSuchKey", err.Error())
+	case utils.KindInvalidArgument:
+		sc.s3Error(w, r, http.StatusBadRequest, "InvalidArgument",
+			err.Error())
+	case utils.KindForbidden, utils.KindUnauthorized:
+		sc.s3Error(w, r, http.StatusForbidden, "AccessDenied", err.Error())
+	case utils.KindConflict:
+		sc.s3Error(w, r, http.StatusForbidden, "InvalidObjectState",
+			err.Error())
+	case utils.KindUnavailable, utils.KindDeadlineExceeded:
+		sc.s3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable",
+			err.Error())
+	default:
+		sc.s3Error(w, r, http.StatusInternalServerError, "InternalError",
+			err.Error())
+	}
+}
+
+// Writes an S3 error response. HEAD responses have no body.
+func (sc *S3Controller) s3Error(w http.ResponseWriter, r *http.Request,
+	status int, code string, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	res := s3ErrorBody{Code: code, Message: message, Resource: r.URL.Path,
+		RequestID: utils.RequestID(r.Context())}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	sc.encodeXML(w, r, res)
+}
+
+// Writes a successful XML response.
+func (sc *S3Controller) writeXML(w http.ResponseWriter, r *http.Request,
+	res interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	sc.encodeXML(w, r, res)
+}
+
+// Encodes an XML document.
+func (sc *S3Controller) encodeXML(w http.ResponseWriter, r *http.Request,
+	res interface{}) {
+	_, err := io.WriteString(w, xml.Header)
+	if err == nil {
+		err = xml.NewEncoder(w).Encode(res)
+	}
+	if err != nil {
+		utils.LoggerFrom(r.Context(), sc.ctx.Log).Error(
+			"Error writing XML output.", "error", err)
+	}
+}
@@ -0,0 +1,231 @@
+package ftp
+
+import (
+	"fmt"
+	"io"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A file or directory in the mirror at the session's point in time
+type node struct {
+	name string
+	dir  bool
+	md   models.Metadata
+	info models.ObjectInfo
+}
+
+// Gets the modification time to show for a node. Directories have none,
+// so they show the session's point in time.
+func (n node) modTime(at string) time.Time {
+	if res, ok := n.md.Modified(); ok {
+		return res
+	}
+	res, _ := time.Parse(utils.TimeLayout, at)
+	return res
+}
+
+// Looks up a file or directory, trying a file first.
+func (s *session) stat(pathName string) (node, error) {
+	if pathName == "/" {
+		return node{name: "/", dir: true}, nil
+	}
+	ctx := s.modelCtx()
+	file := models.NewFile(ctx)
+	md, err := file.MetadataAtTime(s.reqCtx, pathName, s.at())
+	if err == nil {
+		info, err := file.Stat(s.reqCtx, md)
+		return node{name: path.Base(pathName), md: md, info: info}, err
+	}
+	if utils.KindOf(err) != utils.KindNotFound {
+		return node{}, err
+	}
+	_, _, err = models.NewDirectory(ctx).GetChildren(s.reqCtx, pathName+"/", s.at())
+	return node{name: path.Base(pathName), dir: true}, err
+}
+
+// Lists a directory, sub-folders first. Listing a file gives just the
+// file.
+func (s *session) listing(pathName string) ([]node, error) {
+	target, err := s.stat(pathName)
+	if err != nil || !target.dir {
+		return []node{target}, err
+	}
+	ctx := s.modelCtx()
+	dirPath := strings.TrimSuffix(pathName, "/") + "/"
+	files, dirs, err := models.NewDirectory(ctx).GetChildren(s.reqCtx, dirPath,
+		s.at())
+	if err != nil {
+		return nil, err
+	}
+	infos, err := models.NewFile(ctx).StatAll(s.reqCtx, files)
+	if err != nil {
+		return nil, err
+	}
+	res := []node{}
+	for _, name := range dirs {
+		res = append(res, node{name: name, dir: true})
+	}
+	for i, md := range files {
+		if infos[i].Missing {
+			continue
+		}
+		res = append(res, node{name: path.Base(md.Path), md: md,
+			info: infos[i]})
+	}
+	return res, nil
+}
+
+// Gets the path argument of a listing command, skipping ls options like
+// "-la" that many clients send.
+func listArg(arg string) string {
+	fields := strings.Fields(arg)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+		fields = fields[1:]
+	}
+	return strings.Join(fields, " ")
+}
+
+// Formats a node like a line of ls -l.
+func (s *session) lsLine(n node) string {
+	mode := "-r--r--r--"
+	if n.dir {
+		mode = "dr-xr-xr-x"
+	}
+	modTime := n.modTime(s.at())
+	stamp := modTime.Format("Jan _2  2006")
+	if time.Since(modTime) < 180*24*time.Hour {
+		stamp = modTime.Format("Jan _2 15:04")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", mode, n.info.Size, stamp,
+		n.name)
+}
+
+// Formats the facts of a node for MLSD and MLST.
+func (s *session) facts(n node) string {
+	modify := n.modTime(s.at()).Format("20060102150405")
+	if n.dir {
+		return "type=dir;modify=" + modify + ";"
+	}
+	return "type=file;size=" + strconv.FormatInt(n.info.Size, 10) +
+		";modify=" + modify + ";"
+}
+
+// Sends a listing over a data connection, one line per node.
+func (s *session) sendListing(arg string, format func(node) string) {
+	nodes, err := s.listing(s.resolve(listArg(arg)))
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.transfer("listing", func(out io.Writer) error {
+		for _, n := range nodes {
+			if _, err := io.WriteString(out, format(n)+"\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Handles LIST.
+func (s *session) list(arg string) {
+	s.sendListing(arg, s.lsLine)
+}
+
+// Handles NLST.
+func (s *session) nlst(arg string) {
+	s.sendListing(arg, func(n node) string { return n.name })
+}
+
+// Handles MLSD.
+func (s *session) mlsd(arg string) {
+	s.sendListing(arg, func(n node) string {
+		return s.facts(n) + " " + n.name
+	})
+}
+
+// Handles MLST, which describes one file or directory on the control
+// connection.
+func (s *session) mlst(arg string) {
+	target := s.resolve(arg)
+	n, err := s.stat(target)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.replyLines(250, "Listing "+target, []string{s.facts(n) + " " + target},
+		"End")
+}
+
+// Looks up a path that must be a file.
+func (s *session) statFile(arg string) (node, bool) {
+	n, err := s.stat(s.resolve(arg))
+	if err != nil {
+		s.replyError(err)
+		return n, false
+	}
+	if n.dir {
+		s.reply(550, "Not a file.")
+		return n, false
+	}
+	return n, true
+}
+
+// Handles SIZE.
+func (s *session) size(arg string) {
+	if n, ok := s.statFile(arg); ok {
+		s.reply(213, strconv.FormatInt(n.info.Size, 10))
+	}
+}
+
+// Handles MDTM.
+func (s *session) mdtm(arg string) {
+	if n, ok := s.statFile(arg); ok {
+		s.reply(213, n.modTime(s.at()).Format("20060102150405"))
+	}
+}
+
+// Handles REST, which sets the offset for the next RETR.
+func (s *session) rest(arg string) {
+	offset, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+	if err != nil || offset < 0 {
+		s.reply(501, "Invalid offset.")
+		return
+	}
+	s.restAt = offset
+	s.reply(350, "Restarting at "+arg+". Send RETR to continue.")
+}
+
+// Handles RETR, streaming the file from the object store from any
+// offset set by REST.
+func (s *session) retr(arg string) {
+	offset := s.restAt
+	s.restAt = 0
+	n, ok := s.statFile(arg)
+	if !ok {
+		return
+	}
+	if offset >= n.info.Size {
+		s.transfer(n.name, func(io.Writer) error { return nil })
+		return
+	}
+	byteRange := ""
+	if offset > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-", offset)
+	}
+	obj, err := models.NewFile(s.modelCtx()).Open(s.reqCtx, n.md, byteRange)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	defer obj.Body.Close()
+	s.transfer(n.name, func(out io.Writer) error {
+		_, err := io.Copy(out, obj.Body)
+		return err
+	})
+}
@@ -0,0 +1,121 @@
+// Package ftp is a read-only FTP front end to the mirror, so that scripts
+// with hard-coded ftp:// URLs can be pointed at a past state of the NCBI
+// FTP server. The point in time comes from the login name, like
+// "anonymous@2017-06-01", or a "SITE TIME 2017-06-01" command. Listings
+// come from the entries table and downloads stream from the object store.
+// Only passive mode is supported.
+package ftp
+
+import (
+	"context"
+	"errors"
+	"ncbi-tool-server/utils"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Server is a read-only FTP server
+type Server struct {
+	ctx      *utils.Context
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	sessions sync.WaitGroup
+	closing  bool
+}
+
+// NewServer returns a new FTP server for the mirror
+func NewServer(ctx *utils.Context) *Server {
+	return &Server{
+		ctx:   ctx,
+		conns: map[net.Conn]bool{},
+	}
+}
+
+// ListenAndServe listens on addr and serves FTP sessions until Shutdown
+// is called
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return utils.NewErr("Couldn't listen for FTP.", err)
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves FTP sessions on the listener until Shutdown is called.
+// Returns nil after Shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	s.ctx.Log.Info("Serving FTP.", "addr", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.sessions.Add(1)
+		go func() {
+			defer s.sessions.Done()
+			defer func() {
+				// A bug in one session mustn't take the server down. The
+				// session closes its connection as it unwinds.
+				if v := recover(); v != nil {
+					s.ctx.Log.Error("FTP session panicked.", "panic", v,
+						"stack", string(debug.Stack()))
+					conn.Close()
+				}
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			newSession(s.ctx, conn).serve()
+		}()
+	}
+}
+
+// Shutdown stops accepting sessions and waits for the open ones to end
+// until ctx is done, then closes them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,165 @@
+package ftp
+
+import (
+	"context"
+	"database/sql"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"ncbi-tool-server/models"
+	"ncbi-tool-server/utils"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// An object store with one object
+type mockStore struct {
+	s3iface.S3API
+}
+
+func (m mockStore) HeadObjectWithContext(ctx aws.Context,
+	input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput,
+	error) {
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(13)}, nil
+}
+
+func (m mockStore) GetObjectWithContext(ctx aws.Context,
+	input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput,
+	error) {
+	data := "first version"
+	if input.Range != nil {
+		data = data[6:]
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(strings.NewReader(data)),
+	}, nil
+}
+
+// Starts a server with a small mirror and logs in at a point in time.
+func newTestSession(t *testing.T) (*textproto.Conn, func()) {
+	ctx := utils.NewContext()
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("create table entries (PathName text, " +
+		"VersionNum integer, DateModified text, ArchiveKey text)")
+	assert.Nil(t, err)
+	_, err = db.Exec("insert into entries values " +
+		"('/blast/db/README', 1, '2017-01-01T00:00:00', 'README-1'), " +
+		"('/blast/db/README', 2, '2017-07-01T00:00:00', 'README-2'), " +
+		"('/blast/db/v4/nt.tar.gz', 1, '2017-02-01T00:00:00', null)")
+	assert.Nil(t, err)
+	ctx.Db = db
+	assert.Nil(t, models.SetupTables(ctx))
+	ctx.Store = mockStore{}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := NewServer(ctx)
+	go server.Serve(listener)
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	expect(t, conn, "", 220)
+	expect(t, conn, "USER anonymous@2017-06-01", 331)
+	expect(t, conn, "PASS guest@example.org", 230)
+	return conn, func() {
+		conn.Close()
+		server.Shutdown(context.Background())
+	}
+}
+
+// Sends a command, if any, and checks the reply code. Returns the reply.
+func expect(t *testing.T, conn *textproto.Conn, command string,
+	code int) string {
+	if command != "" {
+		assert.Nil(t, conn.PrintfLine("%s", command))
+	}
+	_, msg, err := conn.ReadResponse(code)
+	assert.Nil(t, err, command)
+	return msg
+}
+
+// Opens a passive data connection.
+func dial(t *testing.T, conn *textproto.Conn) net.Conn {
+	msg := expect(t, conn, "EPSV", 229)
+	port, err := strconv.Atoi(strings.Trim(msg[strings.Index(msg, "(")+1:],
+		"|)."))
+	assert.Nil(t, err)
+	data, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	assert.Nil(t, err)
+	return data
+}
+
+func TestListAndRetr(t *testing.T) {
+	conn, done := newTestSession(t)
+	defer done()
+
+	expect(t, conn, "CWD /blast/db", 250)
+	data := dial(t, conn)
+	expect(t, conn, "LIST -la", 150)
+	listing, err := ioutil.ReadAll(data)
+	assert.Nil(t, err)
+	expect(t, conn, "", 226)
+	lines := strings.Split(strings.TrimSpace(string(listing)), "\r\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], "dr-xr-xr-x"))
+	assert.True(t, strings.HasSuffix(lines[0], " v4"))
+	assert.Contains(t, lines[1], "13 Jan  1  2017 README")
+
+	assert.Equal(t, "13", expect(t, conn, "SIZE README", 213))
+	assert.Equal(t, "20170101000000", expect(t, conn, "MDTM README", 213))
+	expect(t, conn, "REST 6", 350)
+	data = dial(t, conn)
+	expect(t, conn, "RETR README", 150)
+	body, err := ioutil.ReadAll(data)
+	assert.Nil(t, err)
+	expect(t, conn, "", 226)
+	assert.Equal(t, "version", string(body))
+
+	expect(t, conn, "RETR nope", 550)
+	expect(t, conn, "STOR README", 550)
+	expect(t, conn, "PORT 127,0,0,1,4,1", 502)
+	expect(t, conn, "QUIT", 221)
+}
+
+func TestUserTime(t *testing.T) {
+	conn, done := newTestSession(t)
+	defer done()
+
+	// A suffix that looks like a date must be a valid one
+	expect(t, conn, "USER anonymous@2017-13-01", 501)
+	expect(t, conn, "PASS guest@example.org", 503)
+	expect(t, conn, "USER guest@example.org", 331)
+	assert.Contains(t, expect(t, conn, "PASS x", 230), "now")
+	expect(t, conn, "USER anonymous@latest", 331)
+	expect(t, conn, "PASS x", 230)
+}
+
+func TestWildcardPaths(t *testing.T) {
+	conn, done := newTestSession(t)
+	defer done()
+
+	expect(t, conn, "CWD /blast/d_", 550)
+	expect(t, conn, "CWD /"+strings.Repeat("%", 100), 550)
+	expect(t, conn, "SIZE /blast/db/READM%", 550)
+	expect(t, conn, "PWD", 257)
+}
+
+func TestSessionPanic(t *testing.T) {
+	conn, done := newTestSession(t)
+	defer done()
+	handlers["XPANIC"] = func(s *session, arg string) { panic("boom") }
+	defer delete(handlers, "XPANIC")
+
+	// Only the session ends
+	assert.Nil(t, conn.PrintfLine("XPANIC"))
+	_, err := conn.ReadLine()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,497 @@
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"ncbi-tool-server/utils"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// idleTimeout closes control connections without commands
+	idleTimeout = 5 * time.Minute
+	// dataTimeout bounds the wait for a client to open a data connection
+	dataTimeout = 30 * time.Second
+	// queryRoute picks the query timeout for FTP commands from the
+	// per-route timeouts
+	queryRoute = "ftp"
+)
+
+// A handler for an FTP command. arg is the rest of the command line.
+type handler func(s *session, arg string)
+
+// Handlers by command. Commands not listed get a 502.
+var handlers map[string]handler
+
+// Commands allowed before logging in
+var beforeLogin = map[string]bool{"USER": true, "PASS": true, "QUIT": true,
+	"SYST": true, "FEAT": true, "OPTS": true, "NOOP": true}
+
+func init() {
+	readOnly := func(s *session, arg string) {
+		s.reply(550, "Read-only server.")
+	}
+	handlers = map[string]handler{
+		"USER": (*session).user,
+		"PASS": (*session).pass,
+		"QUIT": (*session).quit,
+		"SYST": func(s *session, arg string) { s.reply(215, "UNIX Type: L8") },
+		"FEAT": (*session).feat,
+		"OPTS": (*session).opts,
+		"NOOP": func(s *session, arg string) { s.reply(200, "OK.") },
+		"TYPE": (*session).typ,
+		"MODE": (*session).mode,
+		"STRU": (*session).stru,
+		"PWD":  (*session).pwd,
+		"XPWD": (*session).pwd,
+		"CWD":  (*session).cwdCommand,
+		"XCWD": (*session).cwdCommand,
+		"CDUP": func(s *session, arg string) { s.cwdCommand("..") },
+		"XCUP": func(s *session, arg string) { s.cwdCommand("..") },
+		"PASV": (*session).pasv,
+		"EPSV": (*session).epsv,
+		"PORT": (*session).active,
+		"EPRT": (*session).active,
+		"LIST": (*session).list,
+		"NLST": (*session).nlst,
+		"MLSD": (*session).mlsd,
+		"MLST": (*session).mlst,
+		"SIZE": (*session).size,
+		"MDTM": (*session).mdtm,
+		"REST": (*session).rest,
+		"RETR": (*session).retr,
+		"SITE": (*session).site,
+		"STOR": readOnly,
+		"STOU": readOnly,
+		"APPE": readOnly,
+		"DELE": readOnly,
+		"MKD":  readOnly,
+		"XMKD": readOnly,
+		"RMD":  readOnly,
+		"XRMD": readOnly,
+		"RNFR": readOnly,
+		"RNTO": readOnly,
+	}
+}
+
+// An FTP control connection
+type session struct {
+	ctx       *utils.Context
+	reqCtx    context.Context
+	cancel    context.CancelFunc
+	conn      net.Conn
+	reader    *bufio.Reader
+	log       *slog.Logger
+	name      string
+	principal string
+	loggedIn  bool
+	inputTime string
+	cwd       string
+	restAt    int64
+	passive   net.Listener
+	done      bool
+}
+
+// Makes a session for a new control connection.
+func newSession(ctx *utils.Context, conn net.Conn) *session {
+	log := ctx.Log.With("remote", conn.RemoteAddr().String())
+	reqCtx, cancel := context.WithCancel(ctx.RequestCtx)
+	return &session{
+		ctx:    ctx,
+		reqCtx: reqCtx,
+		cancel: cancel,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		log:    log,
+		cwd:    "/",
+	}
+}
+
+// Reads and runs commands until the client quits or the connection ends.
+func (s *session) serve() {
+	defer s.conn.Close()
+	defer s.cancel()
+	defer s.closePassive()
+	s.log.Info("FTP session started.")
+	s.reply(220, "NCBI data tool read-only FTP. Log in as "+
+		"anonymous@<date> to see the mirror as of that date.")
+	for !s.done {
+		s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				s.log.Info("FTP session ended.", "error", err)
+			}
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command, arg := line, ""
+		if space := strings.IndexByte(line, ' '); space >= 0 {
+			command, arg = line[:space], line[space+1:]
+		}
+		command = strings.ToUpper(command)
+		handle, ok := handlers[command]
+		switch {
+		case !ok:
+			s.reply(502, "Command not implemented.")
+		case !s.loggedIn && !beforeLogin[command]:
+			s.reply(530, "Please log in with USER and PASS.")
+		default:
+			handle(s, arg)
+		}
+	}
+}
+
+// Sends a single-line reply.
+func (s *session) reply(code int, message string) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, message)
+}
+
+// Sends a multi-line reply.
+func (s *session) replyLines(code int, first string, lines []string,
+	last string) {
+	msg := fmt.Sprintf("%d-%s\r\n", code, first)
+	for _, line := range lines {
+		msg += " " + line + "\r\n"
+	}
+	msg += fmt.Sprintf("%d %s\r\n", code, last)
+	io.WriteString(s.conn, msg)
+}
+
+// Sends the reply for a failed command. Missing files and versions that
+// must be restored from cold storage get a 550, and other errors a 451
+// since they are likely temporary.
+func (s *session) replyError(err error) {
+	switch utils.KindOf(err) {
+	case utils.KindNotFound:
+		s.reply(550, "No such file or directory.")
+	case utils.KindInvalidArgument:
+		s.reply(501, err.Error())
+	case utils.KindConflict:
+		s.reply(550, err.Error())
+	default:
+		s.log.Error("FTP command failed.", "error", err)
+		s.reply(451, "Requested action aborted. Try again later.")
+	}
+}
+
+// Makes a model context for a command. Its queries are canceled if the
+// session ends.
+func (s *session) modelCtx() *utils.Context {
+	res := *s.ctx
+	res.Log = s.log
+	res.RequestCtx = s.reqCtx
+	res.QueryTimeout = s.ctx.Config.QueryTimeoutFor(queryRoute)
+	return &res
+}
+
+// Handles USER. The name may end with "@<time>" to pick the point in time.
+// A suffix that starts with a digit must be a valid time, so that a typo
+// doesn't silently show the mirror as it is now.
+func (s *session) user(arg string) {
+	s.loggedIn = false
+	s.name = ""
+	s.inputTime = ""
+	name := arg
+	if at := strings.LastIndex(arg, "@"); at >= 0 {
+		suffix := arg[at+1:]
+		inputTime, err := utils.ParsePointInTime(suffix)
+		switch {
+		case suffix == "latest":
+			name = arg[:at]
+		case err == nil:
+			name = arg[:at]
+			s.inputTime = inputTime
+		case suffix != "" && suffix[0] >= '0' && suffix[0] <= '9':
+			s.reply(501, err.Error())
+			return
+		}
+	}
+	s.name = name
+	if s.ctx.Config.Auth.Required {
+		s.reply(331, "Send your API token as the password.")
+		return
+	}
+	s.reply(331, "Any password will do.")
+}
+
+// Handles PASS. If auth is required, the password must be an API token.
+func (s *session) pass(arg string) {
+	if s.name == "" {
+		s.reply(503, "Send USER first.")
+		return
+	}
+	if s.ctx.Config.Auth.Required {
+		s.principal = s.ctx.Config.Auth.Principal(arg)
+		if s.principal == "" {
+			s.log.Warn("FTP login failed.", "user", s.name)
+			s.reply(530, "Invalid API token.")
+			return
+		}
+	}
+	s.loggedIn = true
+	s.cwd = "/"
+	s.log = s.log.With("user", s.name, "principal", s.principal)
+	s.log.Info("FTP login.", "time", s.timeLabel())
+	s.reply(230, "Logged in. Showing the mirror as of "+s.timeLabel()+".")
+}
+
+// Describes the session's point in time.
+func (s *session) timeLabel() string {
+	if s.inputTime == "" {
+		return "now"
+	}
+	return s.inputTime
+}
+
+// Gets the point in time to resolve paths at.
+func (s *session) at() string {
+	if s.inputTime == "" {
+		return time.Now().UTC().Format(utils.TimeLayout)
+	}
+	return s.inputTime
+}
+
+// Handles SITE. SITE TIME <time> changes the point in time, and SITE TIME
+// alone shows it.
+func (s *session) site(arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != "TIME" {
+		s.reply(502, "Only SITE TIME is supported.")
+		return
+	}
+	if len(fields) == 1 {
+		s.reply(200, "Showing the mirror as of "+s.timeLabel()+".")
+		return
+	}
+	if fields[1] == "latest" {
+		s.inputTime = ""
+	} else {
+		inputTime, err := utils.ParsePointInTime(fields[1])
+		if err != nil {
+			s.reply(501, err.Error())
+			return
+		}
+		s.inputTime = inputTime
+	}
+	s.reply(200, "Showing the mirror as of "+s.timeLabel()+".")
+}
+
+// Handles QUIT.
+func (s *session) quit(arg string) {
+	s.reply(221, "Goodbye.")
+	s.done = true
+}
+
+// Handles FEAT.
+func (s *session) feat(arg string) {
+	s.replyLines(211, "Features:", []string{"EPSV", "PASV", "SIZE", "MDTM",
+		"REST STREAM", "MLST type*;size*;modify*;", "UTF8"}, "End")
+}
+
+// Handles OPTS. Paths are always UTF-8.
+func (s *session) opts(arg string) {
+	if strings.ToUpper(strings.TrimSpace(arg)) == "UTF8 ON" {
+		s.reply(200, "Always in UTF-8 mode.")
+		return
+	}
+	s.reply(501, "Option not supported.")
+}
+
+// Handles TYPE. Files are always sent as they are stored.
+func (s *session) typ(arg string) {
+	switch strings.ToUpper(strings.TrimSpace(arg)) {
+	case "A", "A N", "I", "L 8":
+		s.reply(200, "Type set.")
+	default:
+		s.reply(504, "Type not supported.")
+	}
+}
+
+// Handles MODE. Only stream mode is supported.
+func (s *session) mode(arg string) {
+	if strings.ToUpper(arg) != "S" {
+		s.reply(504, "Only stream mode is supported.")
+		return
+	}
+	s.reply(200, "Mode set to S.")
+}
+
+// Handles STRU. Only file structure is supported.
+func (s *session) stru(arg string) {
+	if strings.ToUpper(arg) != "F" {
+		s.reply(504, "Only file structure is supported.")
+		return
+	}
+	s.reply(200, "Structure set to F.")
+}
+
+// Handles PWD.
+func (s *session) pwd(arg string) {
+	s.reply(257, `"`+strings.Replace(s.cwd, `"`, `""`, -1)+
+		`" is the current directory.`)
+}
+
+// Resolves a path argument against the working directory.
+func (s *session) resolve(arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = path.Join(s.cwd, arg)
+	}
+	return path.Clean("/" + arg)
+}
+
+// Handles CWD.
+func (s *session) cwdCommand(arg string) {
+	target := s.resolve(arg)
+	n, err := s.stat(target)
+	if err == nil && !n.dir {
+		s.reply(550, "Not a directory.")
+		return
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.cwd = target
+	s.reply(250, "Directory changed to "+target+".")
+}
+
+// Handles PASV. Only IPv4 addresses can be sent in the reply.
+func (s *session) pasv(arg string) {
+	port, err := s.openPassive()
+	if err != nil {
+		s.log.Error("Couldn't open FTP data port.", "error", err)
+		s.reply(425, "Can't open data connection.")
+		return
+	}
+	host := s.ctx.Config.FTP.PublicHost
+	if host == "" {
+		host, _, _ = net.SplitHostPort(s.conn.LocalAddr().String())
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		s.closePassive()
+		s.reply(425, "Use EPSV for IPv6.")
+		return
+	}
+	s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d).",
+		ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// Handles EPSV.
+func (s *session) epsv(arg string) {
+	if strings.ToUpper(strings.TrimSpace(arg)) == "ALL" {
+		s.reply(200, "EPSV ALL accepted.")
+		return
+	}
+	port, err := s.openPassive()
+	if err != nil {
+		s.log.Error("Couldn't open FTP data port.", "error", err)
+		s.reply(425, "Can't open data connection.")
+		return
+	}
+	s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|).",
+		port))
+}
+
+// Handles PORT and EPRT. Active mode isn't supported.
+func (s *session) active(arg string) {
+	s.reply(502, "Active mode is not supported. Use passive mode.")
+}
+
+// Listens for a data connection on the control connection's address, on
+// a port from the configured range. Returns the port.
+func (s *session) openPassive() (int, error) {
+	s.closePassive()
+	host, _, err := net.SplitHostPort(s.conn.LocalAddr().String())
+	if err != nil {
+		return 0, err
+	}
+	first, last, err := s.ctx.Config.FTP.PassiveRange()
+	if err != nil {
+		return 0, err
+	}
+	if first == 0 {
+		s.passive, err = net.Listen("tcp", net.JoinHostPort(host, "0"))
+	} else {
+		// Start at a random port so sessions don't all race for the first
+		count := last - first + 1
+		start := rand.Intn(count)
+		for i := 0; i < count; i++ {
+			port := first + (start+i)%count
+			s.passive, err = net.Listen("tcp",
+				net.JoinHostPort(host, strconv.Itoa(port)))
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return s.passive.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Stops listening for a data connection.
+func (s *session) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+// Accepts the data connection for a transfer. Only connections from the
+// client's own address are accepted, so no one else can take the data.
+func (s *session) acceptData() (net.Conn, error) {
+	if s.passive == nil {
+		return nil, errors.New("Use PASV or EPSV first.")
+	}
+	defer s.closePassive()
+	clientHost, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	deadline := time.Now().Add(dataTimeout)
+	for {
+		s.passive.(*net.TCPListener).SetDeadline(deadline)
+		conn, err := s.passive.Accept()
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if host == clientHost {
+			return conn, nil
+		}
+		s.log.Warn("Rejected FTP data connection from another host.",
+			"data_remote", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// Runs a transfer over a data connection with the usual replies. send
+// writes the data.
+func (s *session) transfer(what string, send func(out io.Writer) error) {
+	s.reply(150, "Opening data connection for "+what+".")
+	conn, err := s.acceptData()
+	if err != nil {
+		s.reply(425, "Can't open data connection. "+err.Error())
+		return
+	}
+	err = send(conn)
+	closeErr := conn.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.log.Warn("FTP transfer failed.", "what", what, "error", err)
+		s.reply(426, "Transfer aborted.")
+		return
+	}
+	s.reply(226, "Transfer complete.")
+}
@@ -0,0 +1,417 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"ncbi-tool-server/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// auditMaxProblems bounds the problems listed in a report. All of them
+// are counted.
+const auditMaxProblems = 1000
+
+// auditMaxErrors bounds the errors listed in a report, so that an outage
+// doesn't make a huge one
+const auditMaxErrors = 100
+
+// Kinds of audit problems
+const (
+	// ProblemMissing is an entry without its object
+	ProblemMissing = "missing"
+	// ProblemOrphan is an archived object no entry refers to
+	ProblemOrphan = "orphan"
+	// ProblemMismatch is an object whose size or ETag changed since an
+	// earlier audit recorded it. Objects are trusted the first time
+	// they're seen, and multipart ETags aren't checksums of the content,
+	// so this only catches objects replaced or truncated since then.
+	ProblemMismatch = "mismatch"
+)
+
+// Only one audit runs at a time
+var auditRunning atomic.Bool
+
+// startedLayout is how audits' start times are stored, precise enough to
+// order audits started in the same second
+const startedLayout = "2006-01-02T15:04:05.000000000"
+
+// AuditProblem is an inconsistency an audit found
+type AuditProblem struct {
+	Kind    string
+	Path    string `json:",omitempty"`
+	Version int    `json:",omitempty"`
+	Key     string
+	Detail  string `json:",omitempty"`
+}
+
+// AuditReport describes an integrity audit. Checked counts the entries
+// looked up and Listed the archived objects. Problems lists the first
+// auditMaxProblems problems, and the counts are of all of them. Errors
+// are lookups that failed for other reasons, up to auditMaxErrors of them,
+// and ErrorsDropped counts the rest. Finished is empty while the
+// audit runs, and Interrupted is set if it was stopped before checking
+// everything, e.g. by a shutdown.
+type AuditReport struct {
+	RunID         string
+	Started       string
+	Finished      string
+	Interrupted   bool
+	Verify        bool
+	Checked       int
+	Listed        int
+	Missing       int
+	Orphaned      int
+	Mismatched    int
+	Problems      []AuditProblem
+	Errors        []string
+	ErrorsDropped int
+}
+
+// Adds a problem to the report.
+func (r *AuditReport) add(problem AuditProblem) {
+	switch problem.Kind {
+	case ProblemMissing:
+		r.Missing++
+	case ProblemOrphan:
+		r.Orphaned++
+	case ProblemMismatch:
+		r.Mismatched++
+	}
+	if len(r.Problems) < auditMaxProblems {
+		r.Problems = append(r.Problems, problem)
+	}
+}
+
+// Adds an error to the report.
+func (r *AuditReport) fail(err error) {
+	if len(r.Errors) < auditMaxErrors {
+		r.Errors = append(r.Errors, err.Error())
+	} else {
+		r.ErrorsDropped++
+	}
+}
+
+// Audit Model. Reconciles entries with the objects in the store.
+type Audit struct {
+	ctx *utils.Context
+}
+
+// NewAudit returns a new audit instance
+func NewAudit(ctx *utils.Context) *Audit {
+	return &Audit{
+		ctx: ctx,
+	}
+}
+
+// Run audits entries and stored objects and saves the report. Only one
+// audit runs at a time.
+func (a *Audit) Run(verify bool) (AuditReport, error) {
+	res, err := a.begin(verify)
+	if err != nil {
+		return res, err
+	}
+	defer auditRunning.Store(false)
+	err = a.run(&res)
+	return res, err
+}
+
+// Start begins an audit in the background and returns its report so far.
+// The audit outlives the request that started it, but stops when the
+// server shuts down.
+func (a *Audit) Start(verify bool) (AuditReport, error) {
+	res, err := a.begin(verify)
+	if err != nil {
+		return res, err
+	}
+	runCtx, cancel := context.WithCancel(
+		context.WithoutCancel(a.ctx.RequestCtx))
+	stop := context.AfterFunc(a.ctx.JobsCtx, cancel)
+	background := *a.ctx
+	background.RequestCtx = runCtx
+	background.QueryTimeout = 0
+	go func(res AuditReport) {
+		defer auditRunning.Store(false)
+		defer cancel()
+		defer stop()
+		NewAudit(&background).run(&res)
+	}(res)
+	return res, nil
+}
+
+// Get gets the report of an audit, or of the latest audit if runID is
+// empty.
+func (a *Audit) Get(runID string) (res AuditReport, err error) {
+	query := "select Report from audits where ? = '' or RunID = ? " +
+		"order by Started desc limit 1"
+	spanCtx, end := querySpan(a.ctx, "GetAudit", query)
+	defer func() { end(err) }()
+	var report string
+	err = a.ctx.Db.QueryRowContext(spanCtx, query, runID, runID).Scan(
+		&report)
+	switch {
+	case err == sql.ErrNoRows:
+		return res, utils.NotFound("audit_not_found",
+			"No audit found.", err)
+	case err != nil:
+		return res, dbError("Couldn't query audits.", err)
+	}
+	if err = json.Unmarshal([]byte(report), &res); err != nil {
+		return res, dbError("Couldn't read audit report.", err)
+	}
+	return res, nil
+}
+
+// Claims the audit and saves its empty report.
+func (a *Audit) begin(verify bool) (AuditReport, error) {
+	now := time.Now().UTC()
+	res := AuditReport{
+		RunID:    newRunID(now),
+		Started:  now.Format(utils.TimeLayout),
+		Verify:   verify,
+		Problems: []AuditProblem{},
+		Errors:   []string{},
+	}
+	if !auditRunning.CompareAndSwap(false, true) {
+		return res, utils.Conflict("audit_running",
+			"An audit is already running.", nil)
+	}
+	report, _ := json.Marshal(res)
+	_, err := a.ctx.Db.ExecContext(a.ctx.RequestCtx, "insert into audits "+
+		"(RunID, Started, Report) values (?, ?, ?)", res.RunID,
+		now.Format(startedLayout), string(report))
+	if err != nil {
+		auditRunning.Store(false)
+		return res, dbError("Couldn't save audit.", err)
+	}
+	return res, nil
+}
+
+// Runs the audit and saves its report, even if it failed part way or was
+// interrupted.
+func (a *Audit) run(res *AuditReport) error {
+	a.ctx.Log.Info("Starting audit.", "run", res.RunID, "verify",
+		res.Verify)
+	err := a.check(res)
+	if err != nil {
+		res.fail(err)
+	}
+	res.Interrupted = a.ctx.RequestCtx.Err() != nil
+	res.Finished = time.Now().UTC().Format(utils.TimeLayout)
+	report, _ := json.Marshal(res)
+	// Save even if the audit was interrupted
+	saveCtx := context.WithoutCancel(a.ctx.RequestCtx)
+	_, saveErr := a.ctx.Db.ExecContext(saveCtx, "update audits "+
+		"set Finished = ?, Report = ? where RunID = ?", res.Finished,
+		string(report), res.RunID)
+	if saveErr != nil {
+		saveErr = dbError("Couldn't save audit.", saveErr)
+		a.ctx.Log.Error(saveErr.Error())
+		if err == nil {
+			err = saveErr
+		}
+	}
+	a.ctx.Log.Info("Finished audit.", "run", res.RunID,
+		"checked", res.Checked, "missing", res.Missing,
+		"orphaned", res.Orphaned, "mismatched", res.Mismatched,
+		"errors", len(res.Errors)+res.ErrorsDropped, "interrupted", res.Interrupted)
+	return err
+}
+
+// Looks up the object of every entry, then lists the archive for objects
+// without entries.
+func (a *Audit) check(res *AuditReport) error {
+	conf := a.ctx.Config.Audit
+	pace := time.NewTicker(time.Second / time.Duration(conf.RequestsPerSecond))
+	defer pace.Stop()
+	referenced := map[string]bool{}
+	file := NewFile(a.ctx)
+	after := Metadata{}
+	for {
+		page, err := a.page(after, conf.PageSize)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, md := range page {
+			if md.ArchiveKey.Valid {
+				referenced[file.getS3Key(md)] = true
+			}
+		}
+		if err = a.checkPage(res, page, pace); err != nil {
+			return err
+		}
+		after = page[len(page)-1]
+	}
+
+	prefix := "/archive/"
+	err := a.ctx.Store.ListObjectsV2PagesWithContext(a.ctx.RequestCtx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(a.ctx.Bucket),
+			Prefix: aws.String(prefix),
+		}, func(out *s3.ListObjectsV2Output, last bool) bool {
+			for _, obj := range out.Contents {
+				res.Listed++
+				key := aws.StringValue(obj.Key)
+				if !referenced[key] {
+					res.add(AuditProblem{Kind: ProblemOrphan, Key: key})
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return storeError("Couldn't list "+prefix+".", err)
+	}
+	return nil
+}
+
+// Looks up the objects of a page of entries, Workers at a time and paced
+// by pace, and compares them with what earlier audits recorded.
+func (a *Audit) checkPage(res *AuditReport, page []Metadata,
+	pace *time.Ticker) error {
+	var recorded map[versionKey]ObjectInfo
+	if res.Verify {
+		var err error
+		if recorded, err = a.recorded(page); err != nil {
+			return err
+		}
+	}
+	file := NewFile(a.ctx)
+	infos := make([]ObjectInfo, len(page))
+	errs := make([]error, len(page))
+	slots := make(chan struct{}, a.ctx.Config.Audit.Workers)
+	var workers sync.WaitGroup
+	for i := range page {
+		select {
+		case <-pace.C:
+		case <-a.ctx.RequestCtx.Done():
+			workers.Wait()
+			return requestError(a.ctx.RequestCtx.Err())
+		}
+		workers.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer workers.Done()
+			infos[i], errs[i] = file.Stat(a.ctx.RequestCtx, page[i])
+			<-slots
+		}(i)
+	}
+	workers.Wait()
+
+	for i, md := range page {
+		res.Checked++
+		key := file.getS3Key(md)
+		switch {
+		case utils.KindOf(errs[i]) == utils.KindNotFound:
+			res.add(AuditProblem{Kind: ProblemMissing, Path: md.Path,
+				Version: md.Version, Key: key})
+		case errs[i] != nil:
+			res.fail(errs[i])
+		case !res.Verify:
+		default:
+			if err := a.verify(res, md, key, infos[i],
+				recorded); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Compares an object with what an earlier audit recorded, or records it
+// if it's the first time it's seen.
+func (a *Audit) verify(res *AuditReport, md Metadata, key string,
+	info ObjectInfo, recorded map[versionKey]ObjectInfo) error {
+	known, ok := recorded[versionKey{md.Path, md.Version}]
+	if !ok {
+		_, err := a.ctx.Db.ExecContext(a.ctx.RequestCtx,
+			"insert into object_checks (PathName, VersionNum, Size, ETag, "+
+				"CheckedAt) values (?, ?, ?, ?, ?)", md.Path, md.Version,
+			info.Size, info.ETag, time.Now().UTC().Format(utils.TimeLayout))
+		if err != nil {
+			return dbError("Couldn't record object.", err)
+		}
+		return nil
+	}
+	details := []string{}
+	if known.Size != info.Size {
+		details = append(details, fmt.Sprintf("size %d, recorded %d",
+			info.Size, known.Size))
+	}
+	if known.ETag != info.ETag {
+		details = append(details, fmt.Sprintf("ETag %s, recorded %s",
+			info.ETag, known.ETag))
+	}
+	if len(details) > 0 {
+		res.add(AuditProblem{Kind: ProblemMismatch, Path: md.Path,
+			Version: md.Version, Key: key,
+			Detail: strings.Join(details, "; ")})
+	}
+	return nil
+}
+
+// Gets a page of entries after the given one, in path and version order.
+func (a *Audit) page(after Metadata, size int) (res []Metadata,
+	err error) {
+	res = []Metadata{}
+	query := "select * from entries where PathName > ? or " +
+		"(PathName = ? and VersionNum > ?) " +
+		"order by PathName, VersionNum limit ?"
+	spanCtx, end := querySpan(a.ctx, "auditPage", query)
+	defer func() { end(err) }()
+	rows, err := a.ctx.Db.QueryContext(spanCtx, query, after.Path,
+		after.Path, after.Version, size)
+	if err != nil {
+		return res, dbError("Couldn't query entries.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		md := Metadata{}
+		err = rows.Scan(&md.Path, &md.Version, &md.ModTime, &md.ArchiveKey)
+		if err != nil {
+			return res, dbError("Error reading entries.", err)
+		}
+		res = append(res, md)
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading entries.", err)
+	}
+	return res, err
+}
+
+// Gets what earlier audits recorded for a page of entries.
+func (a *Audit) recorded(page []Metadata) (
+	res map[versionKey]ObjectInfo, err error) {
+	res = map[versionKey]ObjectInfo{}
+	query := "select PathName, VersionNum, Size, ETag from object_checks " +
+		"where PathName >= ? and PathName <= ?"
+	spanCtx, end := querySpan(a.ctx, "auditRecorded", query)
+	defer func() { end(err) }()
+	rows, err := a.ctx.Db.QueryContext(spanCtx, query, page[0].Path,
+		page[len(page)-1].Path)
+	if err != nil {
+		return res, dbError("Couldn't query object checks.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key := versionKey{}
+		info := ObjectInfo{}
+		err = rows.Scan(&key.path, &key.version, &info.Size, &info.ETag)
+		if err != nil {
+			return res, dbError("Error reading object checks.", err)
+		}
+		res[key] = info
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading object checks.", err)
+	}
+	return res, err
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"ncbi-tool-server/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchChunk bounds how many paths go in one IN-list
+const batchChunk = 500
+
+// BatchItem asks for a version of a file by number or at a point in time.
+// Neither means the latest version.
+type BatchItem struct {
+	Path    string
+	Version int    `json:",omitempty"`
+	Time    string `json:",omitempty"`
+}
+
+// ResolveBatch resolves many file versions at once. All versions of the
+// paths are fetched with one query per batchChunk paths, picked in
+// memory, and their URLs signed a few at a time. Entries of yanked
+// versions say so, as /file does. Entries and per-item errors are in the
+// order of items. The returned error is for failures
+// of the whole batch.
+func (f *File) ResolveBatch(ctx context.Context, items []BatchItem) (
+	[]Entry, []error, error) {
+	f = f.with(ctx)
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if !seen[item.Path] {
+			seen[item.Path] = true
+			paths = append(paths, item.Path)
+		}
+	}
+	versions := map[string][]Metadata{}
+	yanked := map[versionKey]*Yank{}
+	for start := 0; start < len(paths); start += batchChunk {
+		end := start + batchChunk
+		if end > len(paths) {
+			end = len(paths)
+		}
+		if err := f.versionsOf(paths[start:end], versions); err != nil {
+			return nil, nil, err
+		}
+		yanks, err := NewYanks(f.ctx).forPaths(paths[start:end])
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, yank := range yanks {
+			yanked[key] = yank
+		}
+	}
+
+	// Items asking for a time skip yanked versions unless asked not to
+	skip := yanked
+	if f.ctx.IncludeYanked {
+		skip = nil
+	}
+
+	res := make([]Entry, len(items))
+	errs := make([]error, len(items))
+	slots := make(chan struct{}, signWorkers)
+	var workers sync.WaitGroup
+	for i, item := range items {
+		md, err := pickVersion(versions[item.Path], item, skip)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		workers.Add(1)
+		slots <- struct{}{}
+		go func(i int, md Metadata) {
+			defer workers.Done()
+			res[i], errs[i] = f.entryFromMetadata(md)
+			res[i].Yanked = yanked[versionKey{md.Path, md.Version}]
+			<-slots
+		}(i, md)
+	}
+	workers.Wait()
+	return res, errs, nil
+}
+
+// Gets every version of the given paths into versions, by path.
+func (f *File) versionsOf(paths []string,
+	versions map[string][]Metadata) (err error) {
+	query := "select * from entries where PathName in (?" +
+		strings.Repeat(", ?", len(paths)-1) + ")"
+	args := make([]interface{}, len(paths))
+	for i, pathName := range paths {
+		args[i] = pathName
+	}
+	spanCtx, end := querySpan(f.ctx, "versionsOf", query)
+	defer func() { end(err) }()
+	rows, err := f.ctx.Db.QueryContext(spanCtx, query, args...)
+	if err != nil {
+		return dbError("Couldn't query entries.", err)
+	}
+	defer func() {
+		closeErr := rows.Close()
+		if closeErr != nil {
+			err = utils.ComboErr("Couldn't close db rows.", closeErr, err)
+			f.ctx.Log.Error(err.Error())
+		}
+	}()
+	for rows.Next() {
+		md := Metadata{}
+		err = rows.Scan(&md.Path, &md.Version, &md.ModTime, &md.ArchiveKey)
+		if err != nil {
+			return dbError("Error reading entries.", err)
+		}
+		versions[md.Path] = append(versions[md.Path], md)
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading entries.", err)
+	}
+	return err
+}
+
+// Picks the version a batch item asks for from all versions of its file,
+// the same way GetVersion and GetAtTime would. Items asking for a time
+// skip the versions in skip.
+func pickVersion(versions []Metadata, item BatchItem,
+	skip map[versionKey]*Yank) (Metadata, error) {
+	var at time.Time
+	switch {
+	case item.Path == "":
+		return Metadata{}, utils.InvalidArgument("missing_path",
+			"Every item needs a path.", nil)
+	case item.Version < 0:
+		return Metadata{}, utils.InvalidArgument("invalid_version",
+			"Invalid version.", nil)
+	case item.Version > 0 && item.Time != "":
+		return Metadata{}, utils.InvalidArgument("conflicting_params",
+			"Give either a version or a time, not both.", nil)
+	case item.Time != "":
+		inputTime, err := utils.ParsePointInTime(item.Time)
+		if err != nil {
+			return Metadata{}, err
+		}
+		at, _ = time.Parse(utils.TimeLayout, inputTime)
+	}
+
+	found := false
+	res := Metadata{}
+	for _, md := range versions {
+		if item.Version > 0 && md.Version != item.Version {
+			continue
+		}
+		if item.Time != "" {
+			modTime, ok := md.Modified()
+			if !ok || modTime.After(at) ||
+				skip[versionKey{md.Path, md.Version}] != nil {
+				continue
+			}
+		}
+		if !found || md.Version > res.Version {
+			res = md
+			found = true
+		}
+	}
+	if !found {
+		return res, utils.NotFound("file_not_found",
+			"No results for this query.", nil)
+	}
+	return res, nil
+}
@@ -1,14 +1,15 @@
 package models
 
 import (
-	"errors"
-	"log"
+	"context"
 	"ncbi-tool-server/utils"
-	"path"
 	"sort"
 	"strings"
 )
 
+// Escapes the wildcards of a LIKE pattern, for use with escape '!'
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
 // Directory Model
 type Directory struct {
 	ctx *utils.Context
@@ -21,43 +22,48 @@ func NewDirectory(ctx *utils.Context) *Directory {
 	}
 }
 
+// Gets a copy of the directory model that works for a request context.
+// Spans and queries derive from it, and stop when it's done.
+func (d *Directory) with(ctx context.Context) *Directory {
+	res := *d.ctx
+	res.RequestCtx = ctx
+	return NewDirectory(&res)
+}
+
 // GetPast gets the approximate directory listing at a point in time
 // from the Db.
-func (d *Directory) GetPast(pathName string, inputTime string,
-	output string) ([]Entry, error) {
+func (d *Directory) GetPast(ctx context.Context, pathName string,
+	inputTime string, output string) ([]Entry, error) {
+	d = d.with(ctx)
 	// Setup
 	var err error
 	resp := []Entry{}
 	file := NewFile(d.ctx)
-	url := ""
 
 	// Get archive versions from DB
 	listing, err := d.getAtTimeDb(pathName, inputTime)
-	if err != nil || len(listing) == 0 {
-		return resp, errors.New("empty or non-existent directory")
+	if err != nil {
+		return resp, err
+	}
+	if len(listing) == 0 {
+		return resp, utils.NotFound("directory_not_found",
+			"Empty or non-existent directory.", nil)
 	}
 
-	// Process results
-	downloadName := path.Base(pathName)
+	// Process results. Stop signing URLs if the client has gone away.
 	for _, val := range listing {
-		if output == "with-URLs" {
-			key := file.getS3Key(val)
-			url, err = file.keyToURL(key, downloadName)
-			if err != nil {
-				return resp, err
-			}
+		if err = d.ctx.RequestCtx.Err(); err != nil {
+			return resp, requestError(err)
 		}
-		entry := Entry{
-			Path:    val.Path,
-			Version: val.Version,
-			ModTime: val.ModTime.String,
-			URL:     url,
+		entry, err := file.listingEntry(val, output)
+		if err != nil {
+			return resp, err
 		}
 		resp = append(resp, entry)
 	}
 
 	if len(resp) == 0 {
-		err = errors.New("no results")
+		err = utils.NotFound("directory_not_found", "No results.", nil)
 	}
 	return resp, err
 }
@@ -66,48 +72,163 @@ func (d *Directory) GetPast(pathName string, inputTime string,
 // most recent version of each file in a path before a given date.
 func (d *Directory) getAtTimeDb(pathName string,
 	inputTime string) ([]Metadata, error) {
-	// Query
 	res := []Metadata{}
-	rows, err := d.ctx.Db.Query("select e.PathName, e.VersionNum, "+
-		"e.DateModified, e.ArchiveKey "+
-		"from entries as e "+
-		"inner join ( "+
-		"select max(VersionNum) VersionNum, PathName "+
-		"from entries "+
-		"where PathName LIKE ? "+
-		"and DateModified <= ? "+
-		"group by PathName ) as max "+
-		"on max.PathName = e.PathName "+
-		"and max.VersionNum = e.VersionNum",
-		pathName+"%%", inputTime)
+	err := d.eachAtTimeDb(pathName, inputTime, func(md Metadata) error {
+		res = append(res, md)
+		return nil
+	})
+	return res, err
+}
+
+// Calls fn with each file in the approximate directory state at a given
+// time, in the order the Db returns them. Stops at the first error from
+// fn or when the request is canceled.
+func (d *Directory) eachAtTimeDb(pathName string, inputTime string,
+	fn func(Metadata) error) error {
+	return d.eachAtTimeRows(pathName, inputTime, func(md Metadata) error {
+		// Exclude files in sub-folders with another folder slash
+		rest := md.Path[len(pathName):]
+		if strings.Contains(rest, "/") {
+			return nil
+		}
+		return fn(md)
+	})
+}
+
+// Calls fn with each file under pathName at a given time, including files
+// in sub-folders. Yanked versions are skipped unless the request includes
+// them. Every path fn gets starts with pathName, even where the Db
+// compares paths without case.
+func (d *Directory) eachAtTimeRows(pathName string, inputTime string,
+	fn func(Metadata) error) (err error) {
+	// Query
+	query := "select e.PathName, e.VersionNum, " +
+		"e.DateModified, e.ArchiveKey " +
+		"from entries as e " +
+		"inner join ( " +
+		"select max(VersionNum) VersionNum, PathName " +
+		"from entries " +
+		"where PathName like ? escape '!' " +
+		"and DateModified <= ?" + notYanked(d.ctx, "entries") +
+		" group by PathName ) as max " +
+		"on max.PathName = e.PathName " +
+		"and max.VersionNum = e.VersionNum"
+	spanCtx, end := querySpan(d.ctx, "getAtTimeDb", query)
+	defer func() { end(err) }()
+	rows, err := d.ctx.Db.QueryContext(spanCtx, query,
+		likeEscaper.Replace(pathName)+"%", inputTime)
 	if err != nil {
-		return res, errors.New("no results found")
+		return dbError("Couldn't query entries.", err)
 	}
 	defer func() {
 		closeErr := rows.Close()
 		if closeErr != nil {
 			err = utils.ComboErr("Couldn't close db rows.", closeErr, err)
-			log.Println(err)
+			d.ctx.Log.Error(err.Error())
 		}
 	}()
+	// fn may stream rows to a client, which can take longer than the query
+	if err = liftTimeout(spanCtx); err != nil {
+		return dbError("Couldn't query entries.", err)
+	}
 
 	// Process results
 	for rows.Next() {
 		md := Metadata{}
 		err = rows.Scan(&md.Path, &md.Version, &md.ModTime, &md.ArchiveKey)
 		if err != nil {
-			return res, err
+			return err
 		}
-		// Exclude files in sub-folders with another folder slash
-		rest := md.Path[len(pathName):]
-		if strings.Contains(rest, "/") {
+		if !strings.HasPrefix(md.Path, pathName) {
 			continue
 		}
+		if err = fn(md); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return dbError("Error reading entries.", err)
+	}
+	return nil
+}
+
+// GetTreePage gets up to limit files whose paths start with prefix at a
+// point in time, including files in sub-folders, sorted by path. Only
+// paths from the given one on are included, so that a listing can be
+// read a page at a time.
+func (d *Directory) GetTreePage(ctx context.Context, prefix string,
+	from string, inputTime string, limit int) (res []Metadata, err error) {
+	d = d.with(ctx)
+	res = []Metadata{}
+	query := "select e.PathName, e.VersionNum, " +
+		"e.DateModified, e.ArchiveKey " +
+		"from entries as e " +
+		"inner join ( " +
+		"select max(VersionNum) VersionNum, PathName " +
+		"from entries " +
+		"where PathName like ? escape '!' and PathName >= ? " +
+		"and DateModified <= ?" + notYanked(d.ctx, "entries") +
+		" group by PathName order by PathName limit ? ) as max " +
+		"on max.PathName = e.PathName " +
+		"and max.VersionNum = e.VersionNum " +
+		"order by e.PathName"
+	spanCtx, end := querySpan(d.ctx, "GetTreePage", query)
+	defer func() { end(err) }()
+	rows, err := d.ctx.Db.QueryContext(spanCtx, query,
+		likeEscaper.Replace(prefix)+"%", from, inputTime, limit)
+	if err != nil {
+		return res, dbError("Couldn't query entries.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		md := Metadata{}
+		err = rows.Scan(&md.Path, &md.Version, &md.ModTime, &md.ArchiveKey)
+		if err != nil {
+			return res, dbError("Error reading entries.", err)
+		}
 		res = append(res, md)
 	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading entries.", err)
+	}
 	return res, err
 }
 
+// GetChildren gets the files directly in a directory at a point in time
+// and the names of its sub-folders, both sorted by name. pathName must end
+// with a slash.
+func (d *Directory) GetChildren(ctx context.Context, pathName string,
+	inputTime string) ([]Metadata, []string, error) {
+	d = d.with(ctx)
+	files := []Metadata{}
+	dirs := []string{}
+	seen := map[string]bool{}
+	err := d.eachAtTimeRows(pathName, inputTime, func(md Metadata) error {
+		rest := md.Path[len(pathName):]
+		slash := strings.Index(rest, "/")
+		switch {
+		case slash < 0:
+			files = append(files, md)
+		case !seen[rest[:slash]]:
+			seen[rest[:slash]] = true
+			dirs = append(dirs, rest[:slash])
+		}
+		return nil
+	})
+	if err != nil {
+		return files, dirs, err
+	}
+	if len(files) == 0 && len(dirs) == 0 {
+		return files, dirs, utils.NotFound("directory_not_found",
+			"Empty or non-existent directory.", nil)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	sort.Strings(dirs)
+	return files, dirs, nil
+}
+
 // CompareResponse is for comparing directory diffs between times. Tag is
 // used for labeling files as added, updated, or unchanged.
 type CompareResponse struct {
@@ -115,10 +236,22 @@ type CompareResponse struct {
 	Tag  string
 }
 
+// Columns names the fields of a CompareResponse in the order tabular
+// formats use
+func (c CompareResponse) Columns() []string {
+	return []string{"Tag", "Path"}
+}
+
+// Row formats the fields of a CompareResponse in Columns order
+func (c CompareResponse) Row() []string {
+	return []string{c.Tag, c.Path}
+}
+
 // CompareListing compares the directory state betwen the startDate and
 // endDate and returns a file listing of CompareResponses.
-func (d *Directory) CompareListing(pathName string, startDate string,
-	endDate string) ([]CompareResponse, error) {
+func (d *Directory) CompareListing(ctx context.Context, pathName string,
+	startDate string, endDate string) ([]CompareResponse, error) {
+	d = d.with(ctx)
 	result := []CompareResponse{}
 
 	// Get approximate file listings at start and end dates
@@ -127,7 +260,7 @@ func (d *Directory) CompareListing(pathName string, startDate string,
 	startSet, err := d.getListingAtTime(pathName, startDate)
 	if err != nil {
 		err = utils.NewErr("Error in getting listing at time.", err)
-		log.Print(err)
+		d.ctx.Log.Error(err.Error())
 		return result, err
 	}
 	endSet, err := d.getListingAtTime(pathName, endDate)
@@ -164,26 +297,31 @@ func (d *Directory) CompareListing(pathName string, startDate string,
 func (d *Directory) getListingAtTime(pathName string,
 	inputTime string) (map[string]int, error) {
 	// Query
+	var err error
 	listing := make(map[string]int)
-	rows, err := d.ctx.Db.Query("select e.PathName, e.VersionNum "+
-		"from entries as e "+
-		"inner join ( "+
-		"select max(VersionNum) VersionNum, PathName "+
-		"from entries "+
-		"where PathName LIKE ? "+
-		"and DateModified <= ? "+
-		"group by PathName ) as max "+
-		"on max.PathName = e.PathName "+
-		"and max.VersionNum = e.VersionNum",
-		pathName+"%%", inputTime)
+	query := "select e.PathName, e.VersionNum " +
+		"from entries as e " +
+		"inner join ( " +
+		"select max(VersionNum) VersionNum, PathName " +
+		"from entries " +
+		"where PathName like ? escape '!' " +
+		"and DateModified <= ?" + notYanked(d.ctx, "entries") +
+		" group by PathName ) as max " +
+		"on max.PathName = e.PathName " +
+		"and max.VersionNum = e.VersionNum"
+	spanCtx, end := querySpan(d.ctx, "getListingAtTime", query)
+	defer func() { end(err) }()
+	rows, err := d.ctx.Db.QueryContext(spanCtx, query,
+		likeEscaper.Replace(pathName)+"%", inputTime)
 	if err != nil {
-		return listing, utils.NewErr("No results found at time "+inputTime+".", err)
+		err = dbError("No results found at time "+inputTime+".", err)
+		return listing, err
 	}
 	defer func() {
 		closeErr := rows.Close()
 		if closeErr != nil {
 			err = utils.ComboErr("Couldn't close db rows.", closeErr, err)
-			log.Println(err)
+			d.ctx.Log.Error(err.Error())
 		}
 	}()
 
@@ -197,5 +335,8 @@ func (d *Directory) getListingAtTime(pathName string,
 		}
 		listing[md.Path] = md.Version
 	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading entries.", err)
+	}
 	return listing, err
 }
@@ -1,17 +1,16 @@
 package models
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"mime"
 	"ncbi-tool-server/utils"
 	"path"
 	"strconv"
-	"time"
 	"strings"
+	"time"
 )
 
 // File Model
@@ -26,6 +25,14 @@ func NewFile(ctx *utils.Context) *File {
 	}
 }
 
+// Gets a copy of the file model that works for a request context. Spans
+// and queries derive from it, and stop when it's done.
+func (f *File) with(ctx context.Context) *File {
+	res := *f.ctx
+	res.RequestCtx = ctx
+	return NewFile(&res)
+}
+
 // Metadata about a file version from the db
 type Metadata struct {
 	Path       string
@@ -34,18 +41,68 @@ type Metadata struct {
 	ArchiveKey sql.NullString
 }
 
+// Layouts of DateModified values in the Db
+var modTimeLayouts = []string{utils.TimeLayout, "2006-01-02 15:04:05"}
+
+// Modified parses the modification time of the file version. Returns
+// false if the Db has none or it's malformed.
+func (md Metadata) Modified() (time.Time, bool) {
+	return parseModTime(md.ModTime.String)
+}
+
+// Parses a DateModified value from the Db.
+func parseModTime(value string) (time.Time, bool) {
+	for _, layout := range modTimeLayouts {
+		res, err := time.Parse(layout, value)
+		if err == nil {
+			return res, true
+		}
+	}
+	return time.Time{}, false
+}
+
 // Entry contains info about a file version entry for formatting
 type Entry struct {
 	Path    string `json:",omitempty"`
 	Version int    `json:",omitempty"`
 	ModTime string `json:",omitempty"`
 	URL     string `json:",omitempty"`
+	// Yanked is set for yanked versions. Only filled in by GetHistory,
+	// ResolveBatch and for versions asked for by number.
+	Yanked *Yank `json:",omitempty"`
+	// Status is set instead of URL for versions that must be restored
+	// from cold storage: restore-required or restoring
+	Status string `json:",omitempty"`
+	// Pins are the unexpired pins on the version. Only filled in by
+	// GetHistory.
+	Pins []Pin `json:",omitempty"`
+}
+
+// Modified parses the modification time of the version, like
+// Metadata.Modified.
+func (e Entry) Modified() (time.Time, bool) {
+	return parseModTime(e.ModTime)
+}
+
+// Columns names the fields of an Entry in the order tabular formats use
+func (e Entry) Columns() []string {
+	return []string{"Version", "ModTime", "Path", "URL"}
+}
+
+// Row formats the fields of an Entry in Columns order
+func (e Entry) Row() []string {
+	return []string{strconv.Itoa(e.Version), e.ModTime, e.Path, e.URL}
 }
 
 // GetVersion gets the response for a file and version.
-func (f *File) GetVersion(path string,
+func (f *File) GetVersion(ctx context.Context, path string,
 	version string) (Entry, error) {
-	num, _ := strconv.Atoi(version)
+	f = f.with(ctx)
+	num, err := strconv.Atoi(version)
+	if err != nil || num < 0 {
+		return Entry{}, utils.InvalidArgument("invalid_version",
+			"Invalid version-num "+version+".", err)
+	}
 	info, err := f.entryFromVersion(path, num)
 	if err != nil {
 		return Entry{}, err
@@ -54,8 +111,9 @@ func (f *File) GetVersion(path string,
 }
 
 // GetAtTime gets the file version at/just before the given time.
-func (f *File) GetAtTime(path string,
+func (f *File) GetAtTime(ctx context.Context, path string,
 	inputTime string) (Entry, error) {
+	f = f.with(ctx)
 	info, err := f.versionFromTime(path, inputTime)
 	if err != nil {
 		return Entry{}, err
@@ -65,42 +123,99 @@ func (f *File) GetAtTime(path string,
 
 // Gets an Entry for a file from the metadata information.
 func (f *File) entryFromMetadata(info Metadata) (Entry, error) {
-	key := f.getS3Key(info)
-	downloadName := path.Base(info.Path)
-	url, err := f.keyToURL(key, downloadName)
+	res := Entry{
+		Path:    info.Path,
+		Version: info.Version,
+		ModTime: info.ModTime.String,
+	}
+	status, err := f.checkDownloadable(info)
+	if utils.KindOf(err) == utils.KindConflict {
+		// No URL that would fail, but how to get one
+		res.Status = status
+		return res, nil
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	res.URL, err = f.keyToURL(f.getS3Key(info), f.Disposition(info))
 	if err != nil {
 		return Entry{}, err
 	}
+	return res, err
+}
+
+// Disposition gets the Content-Disposition to download a file version
+// with, as the client asked in the context's URL options.
+func (f *File) Disposition(info Metadata) string {
+	opts := f.ctx.URLOptions
+	name := path.Base(info.Path)
+	if opts.VersionedName {
+		name = versionedName(name, info.Version)
+	}
+	kind := "attachment"
+	if opts.Inline {
+		kind = "inline"
+	}
+	return mime.FormatMediaType(kind, map[string]string{"filename": name})
+}
+
+// Puts a version number in a filename before its extension, so that
+// "nt.00.tar.gz" version 3 becomes "nt.00.v3.tar.gz".
+func versionedName(name string, version int) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if strings.HasSuffix(base, ".tar") {
+		base = strings.TrimSuffix(base, ".tar")
+		ext = ".tar" + ext
+	}
+	return base + ".v" + strconv.Itoa(version) + ext
+}
+
+// Gets an Entry for a directory listing from the metadata information.
+// The URL is only included if output is "with-URLs".
+func (f *File) listingEntry(info Metadata, output string) (Entry, error) {
+	if output == "with-URLs" {
+		return f.entryFromMetadata(info)
+	}
 	return Entry{
-		info.Path,
-		info.Version,
-		info.ModTime.String,
-		url}, err
+		Path:    info.Path,
+		Version: info.Version,
+		ModTime: info.ModTime.String,
+	}, nil
 }
 
 // Gets metadata entry based on file name and given time.
 // Finds the version of the file just before the given time, if any.
+// Yanked versions are skipped unless the request includes them.
 func (f *File) versionFromTime(path string, inputTime string) (Metadata,
 	error) {
-	res := f.ctx.Db.QueryRow("select * from entries where "+
-		"PathName=? and DateModified <= ? order "+
-		"by VersionNum desc limit 1", path, inputTime)
-	return rowToMetadata(res)
+	query := "select * from entries where " +
+		"PathName=? and DateModified <= ?" + notYanked(f.ctx, "entries") +
+		" order by VersionNum desc limit 1"
+	spanCtx, end := querySpan(f.ctx, "versionFromTime", query)
+	res := f.ctx.Db.QueryRowContext(spanCtx, query, path, inputTime)
+	md, err := f.rowToMetadata(res)
+	end(err)
+	return md, err
 }
 
 // Gets the metadata of the specified or latest version of the file.
 func (f *File) entryFromVersion(path string, version int) (Metadata, error) {
-	var res *sql.Row
+	// Get latest version
+	query := "select * from entries " +
+		"where PathName=? order by VersionNum desc limit 1"
+	args := []interface{}{path}
 	if version > 0 {
 		// Get specified version
-		res = f.ctx.Db.QueryRow("select * from entries "+
-			"where PathName=? and VersionNum=?", path, version)
-	} else {
-		// Get latest version
-		res = f.ctx.Db.QueryRow("select * from entries "+
-			"where PathName=? order by VersionNum desc limit 1", path)
+		query = "select * from entries " +
+			"where PathName=? and VersionNum=?"
+		args = append(args, version)
 	}
-	return rowToMetadata(res)
+	spanCtx, end := querySpan(f.ctx, "entryFromVersion", query)
+	res := f.ctx.Db.QueryRowContext(spanCtx, query, args...)
+	md, err := f.rowToMetadata(res)
+	end(err)
+	return md, err
 }
 
 // Gets the S3 key for the given entry.
@@ -114,42 +229,47 @@ func (f *File) getS3Key(info Metadata) string {
 	return fmt.Sprintf("/archive/%s", archiveKey)
 }
 
-// Gets a pre-signed temporary URL from S3 for a key.
+// Gets a signed temporary URL for a key with the context's signer.
 // Serves back link for client downloads.
-func (f *File) keyToURL(key string, downloadName string) (string, error) {
-	req, _ := f.ctx.Store.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(f.ctx.Bucket),
-		Key:    aws.String(key),
-		ResponseContentDisposition: aws.String("attachment; filename=" +
-			downloadName),
-	})
-
-	out, err := req.Presign(1 * time.Hour)
+func (f *File) keyToURL(key string, disposition string) (string, error) {
+	_, span := utils.StartSpan(f.ctx.RequestCtx, "SignURL",
+		attribute.String("aws.s3.bucket", f.ctx.Bucket),
+		attribute.String("aws.s3.key", key))
+	out, err := f.ctx.URLSigner().SignURL(f.ctx.RequestCtx, key,
+		f.ctx.URLTTL(), disposition)
+	utils.EndSpan(span, err)
 	if err != nil {
-		log.Println(out)
-		return "", errors.New("Couldn't generate URL. " + err.Error())
+		f.ctx.Log.Error("Couldn't generate URL.", "key", key,
+			"error", err)
+		return "", utils.Unavailable("presign_failed",
+			"Couldn't generate URL.", err)
 	}
-	out = strings.Replace(out, `\u0026`, "&", -1)
 	return out, err
 }
 
 // GetHistory gets the revision history of a file. Gets list of
 // versions and modTimes.
-func (f *File) GetHistory(path string) ([]Entry, error) {
+func (f *File) GetHistory(ctx context.Context, path string) ([]Entry,
+	error) {
+	f = f.with(ctx)
 	var err error
 	res := []Entry{}
 
 	// Query the database
-	rows, err := f.ctx.Db.Query("select * from entries "+
-		"where PathName=? order by VersionNum desc", path)
+	query := "select * from entries " +
+		"where PathName=? order by VersionNum desc"
+	spanCtx, end := querySpan(f.ctx, "GetHistory", query)
+	defer func() { end(err) }()
+	rows, err := f.ctx.Db.QueryContext(spanCtx, query, path)
 	if err != nil {
+		err = dbError("Couldn't query entries.", err)
 		return res, err
 	}
 	defer func() {
 		closeErr := rows.Close()
 		if closeErr != nil {
 			err = utils.ComboErr("Couldn't close db rows.", closeErr, err)
-			log.Println(err)
+			f.ctx.Log.Error(err.Error())
 		}
 	}()
 
@@ -168,20 +288,82 @@ func (f *File) GetHistory(path string) ([]Entry, error) {
 		}
 		res = append(res, entry)
 	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading entries.", err)
+		return res, err
+	}
+
+	// Attach pins and yanks
+	pins, err := NewPins(f.ctx).List(path)
+	if err != nil {
+		return res, err
+	}
+	yanks, err := NewYanks(f.ctx).forPaths([]string{path})
+	if err != nil {
+		return res, err
+	}
+	for i := range res {
+		res[i].Yanked = yanks[versionKey{path, res[i].Version}]
+	}
+	for _, pin := range pins {
+		for i := range res {
+			if res[i].Version == pin.Version {
+				res[i].Pins = append(res[i].Pins, pin)
+			}
+		}
+	}
+	return res, err
+}
+
+// GetAdjacent gets a version of a file and the versions just before and
+// after it, newest first, in one query. Unlike GetHistory, pins and yanks
+// aren't attached.
+func (f *File) GetAdjacent(ctx context.Context, path string,
+	version int) (res []Entry, err error) {
+	f = f.with(ctx)
+	res = []Entry{}
+	query := "select * from entries where PathName = ? and " +
+		"(VersionNum = ? or " +
+		"VersionNum = (select max(VersionNum) from entries " +
+		"where PathName = ? and VersionNum < ?) or " +
+		"VersionNum = (select min(VersionNum) from entries " +
+		"where PathName = ? and VersionNum > ?)) " +
+		"order by VersionNum desc"
+	spanCtx, end := querySpan(f.ctx, "GetAdjacent", query)
+	defer func() { end(err) }()
+	rows, err := f.ctx.Db.QueryContext(spanCtx, query, path, version,
+		path, version, path, version)
+	if err != nil {
+		return res, dbError("Couldn't query entries.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		md := Metadata{}
+		err = rows.Scan(&md.Path, &md.Version, &md.ModTime, &md.ArchiveKey)
+		if err != nil {
+			return res, dbError("Error reading entries.", err)
+		}
+		res = append(res, Entry{Path: md.Path, Version: md.Version,
+			ModTime: md.ModTime.String})
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading entries.", err)
+	}
 	return res, err
 }
 
 // RowToMetadata converts a SQL row into a Metadata entry and handles errors.
-func rowToMetadata(row *sql.Row) (Metadata, error) {
+func (f *File) rowToMetadata(row *sql.Row) (Metadata, error) {
 	md := Metadata{}
 	err := row.Scan(&md.Path, &md.Version, &md.ModTime, &md.ArchiveKey)
 	switch {
 	case err == sql.ErrNoRows:
-		err = utils.NewErr("No results for this query.", err)
-		log.Print(err)
+		err = utils.NotFound("file_not_found",
+			"No results for this query.", err)
+		f.ctx.Log.Info(err.Error())
 	case err != nil:
-		err = utils.NewErr("Error retrieving results.", err)
-		log.Print(err)
+		err = dbError("Error retrieving results.", err)
+		f.ctx.Log.Error(err.Error())
 	}
 	return md, err
 }
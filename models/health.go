@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"ncbi-tool-server/utils"
+	"sync"
+	"time"
+)
+
+// Health Model
+type Health struct {
+	ctx *utils.Context
+}
+
+// NewHealth returns a new health instance
+func NewHealth(ctx *utils.Context) *Health {
+	return &Health{
+		ctx: ctx,
+	}
+}
+
+// CheckResult is the outcome of checking a single dependency
+type CheckResult struct {
+	Status  string
+	Error   string `json:",omitempty"`
+	Latency string
+}
+
+// Readiness is the aggregate outcome of all dependency checks. Status is
+// "ok" only if every check passed.
+type Readiness struct {
+	Status string
+	Checks map[string]CheckResult
+}
+
+// Ready reports whether the server's dependencies are reachable. Each
+// check runs concurrently and is bounded by the given timeout.
+func (h *Health) Ready(timeout time.Duration) Readiness {
+	checks := map[string]func(context.Context) error{
+		"database": h.pingDb,
+		"entries":  h.checkEntriesTable,
+		"bucket":   h.headBucket,
+	}
+	ctx, cancel := context.WithTimeout(h.ctx.RequestCtx, timeout)
+	defer cancel()
+
+	res := Readiness{Status: "ok", Checks: map[string]CheckResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			result := CheckResult{
+				Status:  "ok",
+				Latency: time.Since(start).String(),
+			}
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[name] = result
+			if err != nil {
+				res.Status = "error"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return res
+}
+
+// Pings the database.
+func (h *Health) pingDb(ctx context.Context) error {
+	if h.ctx.Db == nil {
+		return errors.New("database not configured")
+	}
+	return h.ctx.Db.PingContext(ctx)
+}
+
+// Checks that the entries table exists.
+func (h *Health) checkEntriesTable(ctx context.Context) error {
+	if h.ctx.Db == nil {
+		return errors.New("database not configured")
+	}
+	rows, err := h.ctx.Db.QueryContext(ctx, "show tables like 'entries'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return errors.New("table 'entries' does not exist")
+	}
+	return rows.Err()
+}
+
+// Checks that the bucket exists and is accessible.
+func (h *Health) headBucket(ctx context.Context) error {
+	if h.ctx.Store == nil {
+		return errors.New("object store not configured")
+	}
+	_, err := h.ctx.Store.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(h.ctx.Bucket),
+	})
+	return err
+}
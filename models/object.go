@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"sync"
+)
+
+// statWorkers bounds how many objects are looked up at once for a listing
+const statWorkers = 8
+
+// ObjectInfo describes the stored object for a file version
+type ObjectInfo struct {
+	Size        int64
+	ETag        string
+	ContentType string
+	// Missing is set by StatAll if the object isn't in the store
+	Missing bool
+}
+
+// MetadataAtTime gets the metadata of the version of a file at/just
+// before the given time.
+func (f *File) MetadataAtTime(ctx context.Context, path string,
+	inputTime string) (Metadata, error) {
+	return f.with(ctx).versionFromTime(path, inputTime)
+}
+
+// MetadataForVersion gets the metadata of a version of a file, or of the
+// latest version if version is 0.
+func (f *File) MetadataForVersion(ctx context.Context, path string,
+	version int) (Metadata, error) {
+	return f.with(ctx).entryFromVersion(path, version)
+}
+
+// URL gets a signed download URL for a file version. Fails with a
+// conflict if the version must be restored from cold storage first.
+func (f *File) URL(ctx context.Context, md Metadata) (string, error) {
+	f = f.with(ctx)
+	if _, err := f.checkDownloadable(md); err != nil {
+		return "", err
+	}
+	return f.keyToURL(f.getS3Key(md), f.Disposition(md))
+}
+
+// SignCookies gets the unsigned URL of a file version and the signed
+// cookies that authorize downloading it, if the context's signer supports
+// cookies. Returns false otherwise. Fails like URL for versions in cold
+// storage.
+func (f *File) SignCookies(ctx context.Context, md Metadata) (string,
+	[]*http.Cookie, bool, error) {
+	f = f.with(ctx)
+	signer, ok := f.ctx.URLSigner().(utils.CookieSigner)
+	if !ok {
+		return "", nil, false, nil
+	}
+	if _, err := f.checkDownloadable(md); err != nil {
+		return "", nil, true, err
+	}
+	url, cookies, err := signer.SignCookies(f.getS3Key(md), f.ctx.URLTTL())
+	if err != nil {
+		return "", nil, true, utils.Unavailable("presign_failed",
+			"Couldn't sign cookies.", err)
+	}
+	return url, cookies, true, nil
+}
+
+// Stat looks up the stored object for a file version.
+func (f *File) Stat(ctx context.Context, md Metadata) (ObjectInfo,
+	error) {
+	f = f.with(ctx)
+	out, err := f.ctx.Store.HeadObjectWithContext(f.ctx.RequestCtx,
+		&s3.HeadObjectInput{
+			Bucket: aws.String(f.ctx.Bucket),
+			Key:    aws.String(f.getS3Key(md)),
+		})
+	if err != nil {
+		return ObjectInfo{}, storeError("Couldn't look up "+md.Path+".", err)
+	}
+	return ObjectInfo{
+		Size:        aws.Int64Value(out.ContentLength),
+		ETag:        aws.StringValue(out.ETag),
+		ContentType: aws.StringValue(out.ContentType),
+	}, nil
+}
+
+// StatAll looks up the stored objects for several file versions, a few at
+// a time. Results are in the same order as mds. Objects missing from the
+// store are logged and marked Missing, so that one lost object doesn't
+// fail a whole listing.
+func (f *File) StatAll(ctx context.Context, mds []Metadata) (
+	[]ObjectInfo, error) {
+	f = f.with(ctx)
+	res := make([]ObjectInfo, len(mds))
+	errs := make([]error, len(mds))
+	slots := make(chan struct{}, statWorkers)
+	var workers sync.WaitGroup
+	for i := range mds {
+		workers.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer workers.Done()
+			res[i], errs[i] = f.Stat(ctx, mds[i])
+			<-slots
+		}(i)
+	}
+	workers.Wait()
+	for i, err := range errs {
+		if utils.KindOf(err) == utils.KindNotFound {
+			utils.LoggerFrom(f.ctx.RequestCtx, f.ctx.Log).Warn(
+				"Object is missing from the store.", "path", mds[i].Path,
+				"version", mds[i].Version)
+			res[i].Missing = true
+		} else if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// Open gets the stored object for a file version. byteRange is an HTTP
+// Range header value for part of the object, or empty for all of it. The
+// caller must close the body.
+func (f *File) Open(ctx context.Context, md Metadata, byteRange string) (
+	*s3.GetObjectOutput, error) {
+	f = f.with(ctx)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(f.ctx.Bucket),
+		Key:    aws.String(f.getS3Key(md)),
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	out, err := f.ctx.Store.GetObjectWithContext(f.ctx.RequestCtx, input)
+	if err != nil {
+		return nil, storeError("Couldn't get "+md.Path+".", err)
+	}
+	return out, nil
+}
+
+// Wraps an error from the object store. Missing objects are not found,
+// objects in cold storage must be restored, and anything else means the
+// store is unavailable.
+func storeError(message string, err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "NotFound", "NoSuchKey":
+			return utils.NotFound("object_not_found", message, err)
+		case "InvalidObjectState":
+			return utils.Conflict("restore_required", message, err)
+		}
+	}
+	return utils.Unavailable("store_unavailable", message, err)
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"ncbi-tool-server/utils"
+	"time"
+)
+
+// activePin is the SQL condition for pins that haven't expired. Its
+// argument is the current time.
+const activePin = "(Expires is null or Expires = '' or Expires > ?)"
+
+// Pin keeps a file version from being deleted, for a holder and a reason,
+// until it expires. Expires is empty for pins that don't expire.
+type Pin struct {
+	Path    string `json:",omitempty"`
+	Version int    `json:",omitempty"`
+	Holder  string
+	Reason  string
+	Expires string `json:",omitempty"`
+	Created string `json:",omitempty"`
+}
+
+// Pins Model. Holds versions that teams depend on.
+type Pins struct {
+	ctx *utils.Context
+}
+
+// NewPins returns a new pins instance
+func NewPins(ctx *utils.Context) *Pins {
+	return &Pins{
+		ctx: ctx,
+	}
+}
+
+// Add pins a file version. A holder has at most one pin on a version, so
+// pinning again replaces the reason and expiry.
+func (p *Pins) Add(pin Pin) (Pin, error) {
+	now := time.Now().UTC().Format(utils.TimeLayout)
+	switch {
+	case pin.Path == "":
+		return pin, utils.InvalidArgument("missing_path",
+			"A pin needs a path.", nil)
+	case pin.Version < 1:
+		return pin, utils.InvalidArgument("invalid_version",
+			"A pin needs a version.", nil)
+	case pin.Holder == "":
+		return pin, utils.InvalidArgument("missing_holder",
+			"A pin needs a holder.", nil)
+	case pin.Reason == "":
+		return pin, utils.InvalidArgument("missing_reason",
+			"A pin needs a reason.", nil)
+	}
+	if pin.Expires != "" {
+		expires, err := utils.ParsePointInTime(pin.Expires)
+		if err != nil {
+			return pin, err
+		}
+		if expires <= now {
+			return pin, utils.InvalidArgument("invalid_expires",
+				"Pins must expire in the future.", nil)
+		}
+		pin.Expires = expires
+	}
+	pin.Created = now
+
+	// The pin is only inserted while the version's entries row exists, in
+	// the same statement, so that it can't pin a version being deleted
+	tx, err := p.ctx.Db.BeginTx(p.ctx.RequestCtx, nil)
+	if err != nil {
+		return pin, dbError("Couldn't start transaction.", err)
+	}
+	_, err = tx.ExecContext(p.ctx.RequestCtx, "delete from pins where "+
+		"PathName = ? and VersionNum = ? and Holder = ?",
+		pin.Path, pin.Version, pin.Holder)
+	var count int64
+	if err == nil {
+		var expires interface{}
+		if pin.Expires != "" {
+			expires = pin.Expires
+		}
+		var result sql.Result
+		result, err = tx.ExecContext(p.ctx.RequestCtx, "insert into pins "+
+			"(PathName, VersionNum, Holder, Reason, Expires, Created) "+
+			"select ?, ?, ?, ?, ?, ? from entries "+
+			"where PathName = ? and VersionNum = ? limit 1", pin.Path,
+			pin.Version, pin.Holder, pin.Reason, expires, pin.Created,
+			pin.Path, pin.Version)
+		if err == nil {
+			count, err = result.RowsAffected()
+		}
+	}
+	if err != nil || count == 0 {
+		tx.Rollback()
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return pin, dbError("Couldn't save pin.", err)
+	}
+	if count == 0 {
+		return pin, utils.NotFound("file_not_found",
+			fmt.Sprintf("No version %d of %s.", pin.Version, pin.Path), nil)
+	}
+	return pin, nil
+}
+
+// Remove removes a holder's pin on a file version.
+func (p *Pins) Remove(pathName string, version int, holder string) error {
+	result, err := p.ctx.Db.ExecContext(p.ctx.RequestCtx,
+		"delete from pins where PathName = ? and VersionNum = ? and "+
+			"Holder = ?", pathName, version, holder)
+	var count int64
+	if err == nil {
+		count, err = result.RowsAffected()
+	}
+	if err != nil {
+		return dbError("Couldn't remove pin.", err)
+	}
+	if count == 0 {
+		return utils.NotFound("pin_not_found", fmt.Sprintf(
+			"%s has no pin on version %d of %s.", holder, version,
+			pathName), nil)
+	}
+	return nil
+}
+
+// List lists the pins that haven't expired, of one file or of all files if
+// pathName is empty.
+func (p *Pins) List(pathName string) (res []Pin, err error) {
+	res = []Pin{}
+	query := "select PathName, VersionNum, Holder, Reason, Expires, " +
+		"Created from pins where (? = '' or PathName = ?) and " +
+		activePin + " order by PathName, VersionNum desc, Created"
+	spanCtx, end := querySpan(p.ctx, "ListPins", query)
+	defer func() { end(err) }()
+	rows, err := p.ctx.Db.QueryContext(spanCtx, query, pathName, pathName,
+		time.Now().UTC().Format(utils.TimeLayout))
+	if err != nil {
+		return res, dbError("Couldn't query pins.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		pin := Pin{}
+		var expires sql.NullString
+		err = rows.Scan(&pin.Path, &pin.Version, &pin.Holder, &pin.Reason,
+			&expires, &pin.Created)
+		if err != nil {
+			return res, dbError("Error reading pins.", err)
+		}
+		pin.Expires = expires.String
+		res = append(res, pin)
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading pins.", err)
+	}
+	return res, err
+}
+
+// deleteUnpinned deletes the entries row of a file version in tx unless
+// the version is pinned, and returns whether it was deleted. The check is
+// part of the delete, and Add only inserts a pin along with a read of the
+// entries row, so a version is never deleted with a pin on it.
+func deleteUnpinned(ctx *utils.Context, tx *sql.Tx, pathName string,
+	version int, now string) (bool, error) {
+	result, err := tx.ExecContext(ctx.RequestCtx,
+		"delete from entries where PathName = ? and VersionNum = ? and "+
+			"not exists (select 1 from pins where pins.PathName = ? and "+
+			"pins.VersionNum = ? and "+activePin+")",
+		pathName, version, pathName, version, now)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
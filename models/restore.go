@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"ncbi-tool-server/utils"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Restore statuses of file versions
+const (
+	// StatusAvailable versions can be downloaded
+	StatusAvailable = "available"
+	// StatusRestoreRequired versions are in cold storage and must be
+	// restored before they can be downloaded
+	StatusRestoreRequired = "restore-required"
+	// StatusRestoring versions are being restored
+	StatusRestoring = "restoring"
+	// StatusRestored versions are in cold storage but have a temporary
+	// copy that can be downloaded until it expires
+	StatusRestored = "restored"
+)
+
+// Matches the expiry of a restored copy in a Restore header, like
+// ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+var restoreExpiry = regexp.MustCompile(`expiry-date="([^"]+)"`)
+
+// RestoreInfo describes whether a file version can be downloaded
+type RestoreInfo struct {
+	Path         string
+	Version      int
+	StorageClass string
+	Status       string
+	// Expires is when a restored copy goes back to cold storage
+	Expires string `json:",omitempty"`
+}
+
+// Downloadable is whether the version can be downloaded now
+func (info RestoreInfo) Downloadable() bool {
+	return info.Status == StatusAvailable || info.Status == StatusRestored
+}
+
+// RestoreStatus looks up whether a file version is in cold storage and
+// how far along its restore is.
+func (f *File) RestoreStatus(ctx context.Context, md Metadata) (
+	RestoreInfo, error) {
+	f = f.with(ctx)
+	res := RestoreInfo{Path: md.Path, Version: md.Version,
+		Status: StatusAvailable}
+	out, err := f.ctx.Store.HeadObjectWithContext(f.ctx.RequestCtx,
+		&s3.HeadObjectInput{
+			Bucket: aws.String(f.ctx.Bucket),
+			Key:    aws.String(f.getS3Key(md)),
+		})
+	if err != nil {
+		return res, storeError("Couldn't look up "+md.Path+".", err)
+	}
+	res.StorageClass = aws.StringValue(out.StorageClass)
+	if res.StorageClass == "" {
+		res.StorageClass = s3.StorageClassStandard
+	}
+	cold := res.StorageClass == s3.StorageClassGlacier ||
+		res.StorageClass == s3.StorageClassDeepArchive ||
+		aws.StringValue(out.ArchiveStatus) != ""
+	if !cold {
+		return res, nil
+	}
+	restore := aws.StringValue(out.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="true"`):
+		res.Status = StatusRestoring
+	case strings.Contains(restore, `ongoing-request="false"`):
+		res.Status = StatusRestored
+		if match := restoreExpiry.FindStringSubmatch(restore); match != nil {
+			if expires, err := http.ParseTime(match[1]); err == nil {
+				res.Expires = expires.UTC().Format(utils.TimeLayout)
+			}
+		}
+	default:
+		res.Status = StatusRestoreRequired
+	}
+	return res, nil
+}
+
+// Restore starts restoring a file version from cold storage, if it isn't
+// downloadable or being restored already.
+func (f *File) Restore(ctx context.Context, md Metadata) (RestoreInfo,
+	error) {
+	f = f.with(ctx)
+	res, err := f.RestoreStatus(ctx, md)
+	if err != nil || res.Status != StatusRestoreRequired {
+		return res, err
+	}
+	conf := f.ctx.Config.Cold
+	request := &s3.RestoreRequest{}
+	if res.StorageClass == s3.StorageClassGlacier ||
+		res.StorageClass == s3.StorageClassDeepArchive {
+		// Intelligent-Tiering archives take neither
+		request.Days = aws.Int64(int64(conf.RestoreDays))
+		request.GlacierJobParameters = &s3.GlacierJobParameters{
+			Tier: aws.String(conf.RestoreTier),
+		}
+	}
+	_, err = f.ctx.Store.RestoreObjectWithContext(f.ctx.RequestCtx,
+		&s3.RestoreObjectInput{
+			Bucket:         aws.String(f.ctx.Bucket),
+			Key:            aws.String(f.getS3Key(md)),
+			RestoreRequest: request,
+		})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) &&
+		awsErr.Code() == "RestoreAlreadyInProgress" {
+		err = nil
+	}
+	if err != nil {
+		return res, storeError("Couldn't restore "+md.Path+".", err)
+	}
+	f.ctx.Log.Info("Restoring version.", "path", md.Path,
+		"version", md.Version, "storageClass", res.StorageClass,
+		"days", conf.RestoreDays, "tier", conf.RestoreTier)
+	res.Status = StatusRestoring
+	return res, nil
+}
+
+// Checks that a file version can be downloaded before a URL is made for
+// it. Only archived versions are looked up, and only if the server is set
+// to check, since lifecycle rules only move old archive objects. Returns
+// the status, which is available if the version wasn't looked up.
+func (f *File) checkDownloadable(md Metadata) (string, error) {
+	if !f.ctx.Config.Cold.Check || !md.ArchiveKey.Valid {
+		return StatusAvailable, nil
+	}
+	info, err := f.RestoreStatus(f.ctx.RequestCtx, md)
+	if err != nil {
+		return info.Status, err
+	}
+	if !info.Downloadable() {
+		return info.Status, restoreError(md, info.Status)
+	}
+	return info.Status, nil
+}
+
+// Makes the error for downloading a version that isn't restored.
+func restoreError(md Metadata, status string) error {
+	if status == StatusRestoring {
+		return utils.Conflict("restoring", md.Path+" is being restored "+
+			"from cold storage. Try again later.", nil)
+	}
+	return utils.Conflict("restore_required", md.Path+" is in cold "+
+		"storage. Restore it with POST /file/restore first.", nil)
+}
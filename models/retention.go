@@ -0,0 +1,418 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"ncbi-tool-server/utils"
+	"path"
+	"strings"
+	"time"
+)
+
+// Retention Model. Garbage collects archived versions by the configured
+// retention rules.
+type Retention struct {
+	ctx *utils.Context
+}
+
+// NewRetention returns a new retention instance
+func NewRetention(ctx *utils.Context) *Retention {
+	return &Retention{
+		ctx: ctx,
+	}
+}
+
+// Deletion is a version that garbage collection removed, or would remove
+// in a dry run
+type Deletion struct {
+	RunID      string
+	Path       string
+	Version    int
+	ModTime    string `json:",omitempty"`
+	ArchiveKey string
+	Rule       string
+	Principal  string
+	DeletedAt  string `json:",omitempty"`
+}
+
+// GCReport describes a garbage collection run. Checked counts the versions
+// a rule applied to, and Protected those kept only because they're pinned
+// or referenced by a snapshot.
+type GCReport struct {
+	RunID     string
+	DryRun    bool
+	Started   string
+	Finished  string
+	Checked   int
+	Protected int
+	Deleted   []Deletion
+	Errors    []string
+}
+
+// A version and the rule that would delete it
+type gcCandidate struct {
+	md   Metadata
+	rule utils.RetentionRule
+}
+
+// Key of a file version in the pins table
+type versionKey struct {
+	path    string
+	version int
+}
+
+// Collect runs garbage collection. Versions no rule keeps are removed from
+// entries and the object store, and recorded in the deletions table with
+// the principal that ran it. A dry run only reports what would be
+// removed. Failures to delete single versions are reported in the report
+// without stopping the run.
+func (rt *Retention) Collect(principal string, dryRun bool) (GCReport,
+	error) {
+	now := time.Now().UTC()
+	res := GCReport{
+		RunID:   newRunID(now),
+		DryRun:  dryRun,
+		Started: now.Format(utils.TimeLayout),
+		Deleted: []Deletion{},
+		Errors:  []string{},
+	}
+	pins, err := rt.pinned(now)
+	if err != nil {
+		return res, err
+	}
+	yanked, err := rt.yanked()
+	if err != nil {
+		return res, err
+	}
+	snapshots := []time.Time{}
+	for _, snapshot := range rt.ctx.Config.Retention.Snapshots {
+		value, err := utils.ParsePointInTime(snapshot)
+		if err != nil {
+			return res, err
+		}
+		at, _ := time.Parse(utils.TimeLayout, value)
+		snapshots = append(snapshots, at)
+	}
+
+	candidates := []gcCandidate{}
+	for i, rule := range rt.ctx.Config.Retention.Rules {
+		err = rt.eachPath(rule.Pattern, func(versions []Metadata) {
+			if firstRule(rt.ctx.Config.Retention.Rules,
+				versions[0].Path) != i {
+				return
+			}
+			res.Checked += len(versions)
+			for _, md := range expired(versions, rule, now) {
+				if pins[versionKey{md.Path, md.Version}] ||
+					inSnapshot(versions, md, snapshots, yanked) {
+					res.Protected++
+					continue
+				}
+				candidates = append(candidates, gcCandidate{md, rule})
+			}
+		})
+		if err != nil {
+			return res, err
+		}
+	}
+
+	for _, c := range candidates {
+		del := Deletion{
+			RunID:      res.RunID,
+			Path:       c.md.Path,
+			Version:    c.md.Version,
+			ModTime:    c.md.ModTime.String,
+			ArchiveKey: c.md.ArchiveKey.String,
+			Rule:       c.rule.Pattern,
+			Principal:  principal,
+		}
+		if !dryRun {
+			deleted, err := rt.remove(&del, c.md)
+			if err != nil {
+				res.Errors = append(res.Errors, err.Error())
+				rt.ctx.Log.Error("Couldn't delete version.", "path",
+					del.Path, "version", del.Version, "error", err)
+			}
+			if !deleted {
+				continue
+			}
+			rt.ctx.Log.Info("Deleted version.", "run", res.RunID,
+				"path", del.Path, "version", del.Version, "rule", del.Rule,
+				"principal", principal)
+		}
+		res.Deleted = append(res.Deleted, del)
+	}
+	res.Finished = time.Now().UTC().Format(utils.TimeLayout)
+	return res, nil
+}
+
+// Makes an ID for a garbage collection run.
+func newRunID(now time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return now.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// Gets the index of the first rule that applies to a path, or -1.
+func firstRule(rules []utils.RetentionRule, pathName string) int {
+	for i, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, pathName); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// Picks the versions of a file that a rule doesn't keep. versions is
+// newest first. Versions that aren't archived are the live files, and
+// versions without a readable time can't be dated, so both are kept. A
+// month with a version kept for another reason needs no monthly version.
+func expired(versions []Metadata, rule utils.RetentionRule,
+	now time.Time) []Metadata {
+	res := []Metadata{}
+	months := map[string]bool{}
+	for i, md := range versions {
+		modTime, ok := md.Modified()
+		if !ok {
+			continue
+		}
+		month := modTime.Format("2006-01")
+		if i < rule.KeepLast || !md.ArchiveKey.Valid {
+			months[month] = true
+			continue
+		}
+		if rule.MonthlyAfter.Duration > 0 &&
+			now.Sub(modTime) > rule.MonthlyAfter.Duration &&
+			!months[month] {
+			// Newest version of the month
+			months[month] = true
+			continue
+		}
+		res = append(res, md)
+	}
+	return res
+}
+
+// Whether a version was the current one at any of the snapshot times.
+// versions is newest first. Like at-time resolution, yanked versions are
+// passed over, but they're kept too for requests that include them.
+func inSnapshot(versions []Metadata, md Metadata, snapshots []time.Time,
+	yanked map[versionKey]bool) bool {
+	for _, at := range snapshots {
+		for _, other := range versions {
+			modTime, ok := other.Modified()
+			if ok && !modTime.After(at) {
+				if other.Version == md.Version {
+					return true
+				}
+				if !yanked[versionKey{other.Path, other.Version}] {
+					break
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Calls fn with the versions of each path that may match a glob, newest
+// first. The rows are read before fn sees them, so fn may query the Db.
+func (rt *Retention) eachPath(pattern string, fn func([]Metadata)) (
+	err error) {
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+	query := "select * from entries where PathName like ? escape '!' " +
+		"order by PathName, VersionNum desc"
+	spanCtx, end := querySpan(rt.ctx, "retentionCandidates", query)
+	defer func() { end(err) }()
+	rows, err := rt.ctx.Db.QueryContext(spanCtx, query,
+		likeEscaper.Replace(prefix)+"%")
+	if err != nil {
+		return dbError("Couldn't query entries.", err)
+	}
+	// Reading every version under a broad pattern can outlast the query
+	if err = liftTimeout(spanCtx); err != nil {
+		rows.Close()
+		return dbError("Couldn't query entries.", err)
+	}
+	all := []Metadata{}
+	for rows.Next() {
+		md := Metadata{}
+		err = rows.Scan(&md.Path, &md.Version, &md.ModTime, &md.ArchiveKey)
+		if err != nil {
+			rows.Close()
+			return dbError("Error reading entries.", err)
+		}
+		all = append(all, md)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return dbError("Error reading entries.", err)
+	}
+	if err = rows.Close(); err != nil {
+		return dbError("Couldn't close db rows.", err)
+	}
+
+	for start := 0; start < len(all); {
+		end := start + 1
+		for end < len(all) && all[end].Path == all[start].Path {
+			end++
+		}
+		fn(all[start:end])
+		start = end
+	}
+	return nil
+}
+
+// Gets the versions with a pin that hasn't expired.
+func (rt *Retention) pinned(now time.Time) (res map[versionKey]bool,
+	err error) {
+	res = map[versionKey]bool{}
+	query := "select PathName, VersionNum from pins where " + activePin
+	spanCtx, end := querySpan(rt.ctx, "pinned", query)
+	defer func() { end(err) }()
+	rows, err := rt.ctx.Db.QueryContext(spanCtx, query,
+		now.Format(utils.TimeLayout))
+	if err != nil {
+		return res, dbError("Couldn't query pins.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key := versionKey{}
+		if err = rows.Scan(&key.path, &key.version); err != nil {
+			return res, dbError("Error reading pins.", err)
+		}
+		res[key] = true
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading pins.", err)
+	}
+	return res, err
+}
+
+// Gets the yanked versions.
+func (rt *Retention) yanked() (res map[versionKey]bool, err error) {
+	res = map[versionKey]bool{}
+	query := "select PathName, VersionNum from yanks"
+	spanCtx, end := querySpan(rt.ctx, "yanked", query)
+	defer func() { end(err) }()
+	rows, err := rt.ctx.Db.QueryContext(spanCtx, query)
+	if err != nil {
+		return res, dbError("Couldn't query yanks.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key := versionKey{}
+		if err = rows.Scan(&key.path, &key.version); err != nil {
+			return res, dbError("Error reading yanks.", err)
+		}
+		res[key] = true
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading yanks.", err)
+	}
+	return res, err
+}
+
+// Removes a version: its entries row and audit record in one transaction,
+// then its object. The row isn't deleted if the version was pinned in the
+// meantime, and false is returned. The object is kept if other rows still
+// refer to it. A failure to delete the object leaves an unreferenced
+// object behind, which is safe to clean up later.
+func (rt *Retention) remove(del *Deletion, md Metadata) (bool, error) {
+	del.DeletedAt = time.Now().UTC().Format(utils.TimeLayout)
+	tx, err := rt.ctx.Db.BeginTx(rt.ctx.RequestCtx, nil)
+	if err != nil {
+		return false, dbError("Couldn't start transaction.", err)
+	}
+	deleted, err := deleteUnpinned(rt.ctx, tx, del.Path, del.Version,
+		del.DeletedAt)
+	if err == nil && deleted {
+		_, err = tx.ExecContext(rt.ctx.RequestCtx,
+			"insert into deletions (RunID, PathName, VersionNum, "+
+				"DateModified, ArchiveKey, Rule, Principal, DeletedAt) "+
+				"values (?, ?, ?, ?, ?, ?, ?, ?)",
+			del.RunID, del.Path, del.Version, del.ModTime, del.ArchiveKey,
+			del.Rule, del.Principal, del.DeletedAt)
+	}
+	shared := false
+	if err == nil && deleted {
+		shared, err = rt.objectShared(tx, md)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return false, dbError("Couldn't delete "+del.Path+".", err)
+	}
+	if !deleted || shared {
+		return deleted, nil
+	}
+
+	key := NewFile(rt.ctx).getS3Key(md)
+	_, err = rt.ctx.Store.DeleteObjectWithContext(rt.ctx.RequestCtx,
+		&s3.DeleteObjectInput{
+			Bucket: aws.String(rt.ctx.Bucket),
+			Key:    aws.String(key),
+		})
+	if err != nil {
+		return true, storeError("Couldn't delete object "+key+".", err)
+	}
+	return true, nil
+}
+
+// Reports whether any entries rows in tx still refer to the object of a
+// version, as versions may share an archive key.
+func (rt *Retention) objectShared(tx *sql.Tx, md Metadata) (bool, error) {
+	query := "select count(*) from entries where ArchiveKey = ?"
+	arg := md.ArchiveKey.String
+	if !md.ArchiveKey.Valid {
+		query = "select count(*) from entries where PathName = ? and " +
+			"ArchiveKey is null"
+		arg = md.Path
+	}
+	count := 0
+	err := tx.QueryRowContext(rt.ctx.RequestCtx, query, arg).Scan(&count)
+	return count > 0, err
+}
+
+// Deletions lists the audit trail of garbage collection, newest first,
+// optionally only for one run or path.
+func (rt *Retention) Deletions(runID string, pathName string) (
+	res []Deletion, err error) {
+	res = []Deletion{}
+	query := "select RunID, PathName, VersionNum, DateModified, " +
+		"ArchiveKey, Rule, Principal, DeletedAt from deletions " +
+		"where (? = '' or RunID = ?) and (? = '' or PathName = ?) " +
+		"order by DeletedAt desc, PathName, VersionNum"
+	spanCtx, end := querySpan(rt.ctx, "deletions", query)
+	defer func() { end(err) }()
+	rows, err := rt.ctx.Db.QueryContext(spanCtx, query, runID, runID,
+		pathName, pathName)
+	if err != nil {
+		return res, dbError("Couldn't query deletions.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		del := Deletion{}
+		var modTime, archiveKey sql.NullString
+		err = rows.Scan(&del.RunID, &del.Path, &del.Version, &modTime,
+			&archiveKey, &del.Rule, &del.Principal, &del.DeletedAt)
+		if err != nil {
+			return res, dbError("Error reading deletions.", err)
+		}
+		del.ModTime = modTime.String
+		del.ArchiveKey = archiveKey.String
+		res = append(res, del)
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading deletions.", err)
+	}
+	return res, err
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"ncbi-tool-server/utils"
+)
+
+// Tables the server keeps besides entries, which the sync job owns. The
+// SQL works on both MySQL and SQLite.
+var tables = []string{
+	// Versions that must not be deleted. Expires is empty for pins that
+	// don't expire. Garbage collection reads it, so it's created with the
+	// deletions table even though only the pin endpoints write it.
+	"create table if not exists pins (" +
+		"PathName varchar(1024) not null, " +
+		"VersionNum integer not null, " +
+		"Holder varchar(255) not null, " +
+		"Reason text not null, " +
+		"Expires varchar(32), " +
+		"Created varchar(32) not null)",
+	// Audit trail of versions removed by garbage collection
+	"create table if not exists deletions (" +
+		"RunID varchar(64) not null, " +
+		"PathName varchar(1024) not null, " +
+		"VersionNum integer not null, " +
+		"DateModified varchar(32), " +
+		"ArchiveKey varchar(1024), " +
+		"Rule varchar(1024) not null, " +
+		"Principal varchar(255) not null, " +
+		"DeletedAt varchar(32) not null)",
+	// Integrity audit reports, as JSON. Finished is empty while running.
+	// Started has sub-second precision for ordering.
+	"create table if not exists audits (" +
+		"RunID varchar(64) not null, " +
+		"Started varchar(32) not null, " +
+		"Finished varchar(32), " +
+		"Report mediumtext)",
+	// Versions at-time resolution skips, with the version to use instead
+	"create table if not exists yanks (" +
+		"PathName varchar(1024) not null, " +
+		"VersionNum integer not null, " +
+		"Reason text not null, " +
+		"Replacement integer, " +
+		"Principal varchar(255) not null, " +
+		"Created varchar(32) not null)",
+	// Object sizes and ETags first seen by an audit, for verifying later
+	"create table if not exists object_checks (" +
+		"PathName varchar(1024) not null, " +
+		"VersionNum integer not null, " +
+		"Size bigint not null, " +
+		"ETag varchar(255) not null, " +
+		"CheckedAt varchar(32) not null)",
+}
+
+// SetupTables creates the server's own tables if they don't exist.
+func SetupTables(ctx *utils.Context) error {
+	for _, query := range tables {
+		if _, err := ctx.Db.ExecContext(ctx.RequestCtx, query); err != nil {
+			return dbError("Couldn't create tables.", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"ncbi-tool-server/utils"
+	"sync"
+)
+
+// signWorkers bounds how many URLs are signed at once while streaming a
+// listing or resolving a batch
+const signWorkers = 8
+
+// A listing entry being produced by a signing worker
+type pendingEntry struct {
+	entry Entry
+	err   error
+}
+
+// StreamPast streams the approximate directory listing at a point in time
+// from the Db. Entries are passed to emit in listing order as they are
+// produced, without holding the whole listing in memory. URLs are presigned
+// by a bounded pool of workers if output is "with-URLs". Stops promptly if
+// the request is canceled or emit fails.
+func (d *Directory) StreamPast(ctx context.Context, pathName string,
+	inputTime string, output string, emit func(Entry) error) error {
+	// Cancel before waiting for the workers, so that they stop
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream := *d.ctx
+	stream.RequestCtx = ctx
+	dir := NewDirectory(&stream)
+	file := NewFile(&stream)
+
+	// Workers sign entries in any order. Each entry's result channel is
+	// queued in listing order, which bounds how far ahead they get.
+	type job struct {
+		md   Metadata
+		done chan pendingEntry
+	}
+	jobs := make(chan job)
+	queue := make(chan chan pendingEntry, 2*signWorkers)
+	for i := 0; i < signWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				entry, err := file.listingEntry(j.md, output)
+				j.done <- pendingEntry{entry, err}
+			}
+		}()
+	}
+
+	// Read rows into the queue
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		readErr <- dir.eachAtTimeDb(pathName, inputTime,
+			func(md Metadata) error {
+				done := make(chan pendingEntry, 1)
+				select {
+				case queue <- done:
+				case <-ctx.Done():
+					return requestError(ctx.Err())
+				}
+				select {
+				case jobs <- job{md, done}:
+				case <-ctx.Done():
+					return requestError(ctx.Err())
+				}
+				return nil
+			})
+	}()
+
+	// Emit entries in order
+	count := 0
+	for done := range queue {
+		var res pendingEntry
+		select {
+		case res = <-done:
+		case <-ctx.Done():
+			return requestError(ctx.Err())
+		}
+		if res.err == nil {
+			res.err = emit(res.entry)
+		}
+		if res.err != nil {
+			return res.err
+		}
+		count++
+	}
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if count == 0 {
+		return utils.NotFound("directory_not_found",
+			"Empty or non-existent directory.", nil)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"ncbi-tool-server/utils"
+	"sync/atomic"
+	"time"
+)
+
+// Starts a query against the entries table, in a span that is a child of
+// the request being served. The query is bounded by the context's query
+// timeout until liftTimeout is called on the returned context, so callers
+// that hand each row to a client lift it once the rows start arriving.
+// The returned function ends the span and releases the timeout, so call
+// it once the rows have been read.
+func querySpan(ctx *utils.Context, name string,
+	query string) (context.Context, func(error)) {
+	spanCtx, span := utils.StartSpan(ctx.RequestCtx, "entries."+name,
+		attribute.String("db.system", "mysql"),
+		attribute.String("db.statement", query))
+	res := &queryCtx{}
+	res.Context, res.cancel = context.WithCancel(spanCtx)
+	if ctx.QueryTimeout > 0 {
+		res.deadline = time.Now().Add(ctx.QueryTimeout)
+		res.timer = time.AfterFunc(ctx.QueryTimeout, func() {
+			res.timedOut.Store(true)
+			res.cancel()
+		})
+	}
+	return res, func(err error) {
+		if res.timer != nil {
+			res.timer.Stop()
+		}
+		res.cancel()
+		utils.EndSpan(span, err)
+	}
+}
+
+// The context of a query, which is canceled if the query runs out of time
+// before its timeout is lifted
+type queryCtx struct {
+	context.Context
+	cancel   context.CancelFunc
+	deadline time.Time
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+// Err reports a query that ran out of time as past its deadline, like a
+// context from context.WithTimeout.
+func (q *queryCtx) Err() error {
+	err := q.Context.Err()
+	if err != nil && q.timedOut.Load() {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// Lifts the timeout of a context from querySpan once its query has
+// started returning rows. The rows can then be read for as long as the
+// request lasts. Fails if the query already ran out of time.
+func liftTimeout(ctx context.Context) error {
+	q, ok := ctx.(*queryCtx)
+	if !ok || q.timer == nil {
+		return nil
+	}
+	if !q.timer.Stop() || !time.Now().Before(q.deadline) {
+		q.timedOut.Store(true)
+		q.cancel()
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// Wraps an error from the Db. Queries that ran out of time get a deadline
+// exceeded error, and anything else means the Db is unavailable.
+func dbError(message string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return utils.DeadlineExceeded("query_timeout",
+			message+" The query timed out.", err)
+	}
+	return utils.Unavailable("database_unavailable", message, err)
+}
+
+// Wraps the error of a request context that is done: the request ran out
+// of time or was canceled, usually because the client went away.
+func requestError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return utils.DeadlineExceeded("request_timeout",
+			"The request timed out.", err)
+	}
+	return utils.Canceled("request_canceled", "The request was canceled.",
+		err)
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"ncbi-tool-server/utils"
+	"strings"
+	"time"
+)
+
+// Yank marks a file version as one not to use, like a corrupt file that
+// was replaced. Replacement is the version to use instead, if any.
+type Yank struct {
+	Path        string `json:",omitempty"`
+	Version     int    `json:",omitempty"`
+	Reason      string
+	Replacement int `json:",omitempty"`
+	Principal   string
+	Created     string
+}
+
+// Warning describes the yank for a Warning header.
+func (y Yank) Warning() string {
+	res := fmt.Sprintf("Version %d of %s was yanked: %s", y.Version, y.Path,
+		y.Reason)
+	if y.Replacement > 0 {
+		res += fmt.Sprintf(" Use version %d instead.", y.Replacement)
+	}
+	return res
+}
+
+// Yanks Model. Marks versions that at-time resolution skips.
+type Yanks struct {
+	ctx *utils.Context
+}
+
+// NewYanks returns a new yanks instance
+func NewYanks(ctx *utils.Context) *Yanks {
+	return &Yanks{
+		ctx: ctx,
+	}
+}
+
+// Add yanks a file version. Yanking it again replaces the reason and
+// replacement.
+func (y *Yanks) Add(yank Yank) (Yank, error) {
+	switch {
+	case yank.Reason == "":
+		return yank, utils.InvalidArgument("missing_reason",
+			"A yank needs a reason.", nil)
+	case yank.Version < 1:
+		return yank, utils.InvalidArgument("invalid_version",
+			"A yank needs a version.", nil)
+	case yank.Replacement == yank.Version:
+		return yank, utils.InvalidArgument("invalid_replacement",
+			"A version can't replace itself.", nil)
+	}
+	file := NewFile(y.ctx)
+	if _, err := file.MetadataForVersion(y.ctx.RequestCtx, yank.Path,
+		yank.Version); err != nil {
+		return yank, err
+	}
+	if yank.Replacement > 0 {
+		_, err := file.MetadataForVersion(y.ctx.RequestCtx, yank.Path,
+			yank.Replacement)
+		if err != nil {
+			return yank, err
+		}
+	}
+	yank.Created = time.Now().UTC().Format(utils.TimeLayout)
+
+	tx, err := y.ctx.Db.BeginTx(y.ctx.RequestCtx, nil)
+	if err != nil {
+		return yank, dbError("Couldn't start transaction.", err)
+	}
+	_, err = tx.ExecContext(y.ctx.RequestCtx, "delete from yanks where "+
+		"PathName = ? and VersionNum = ?", yank.Path, yank.Version)
+	if err == nil {
+		var replacement interface{}
+		if yank.Replacement > 0 {
+			replacement = yank.Replacement
+		}
+		_, err = tx.ExecContext(y.ctx.RequestCtx, "insert into yanks "+
+			"(PathName, VersionNum, Reason, Replacement, Principal, "+
+			"Created) values (?, ?, ?, ?, ?, ?)", yank.Path, yank.Version,
+			yank.Reason, replacement, yank.Principal, yank.Created)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return yank, dbError("Couldn't save yank.", err)
+	}
+	return yank, nil
+}
+
+// Remove unyanks a file version.
+func (y *Yanks) Remove(pathName string, version int) error {
+	result, err := y.ctx.Db.ExecContext(y.ctx.RequestCtx,
+		"delete from yanks where PathName = ? and VersionNum = ?",
+		pathName, version)
+	var count int64
+	if err == nil {
+		count, err = result.RowsAffected()
+	}
+	if err != nil {
+		return dbError("Couldn't remove yank.", err)
+	}
+	if count == 0 {
+		return utils.NotFound("yank_not_found", fmt.Sprintf(
+			"Version %d of %s isn't yanked.", version, pathName), nil)
+	}
+	return nil
+}
+
+// Get gets the yank of a file version, or nil if it isn't yanked.
+func (y *Yanks) Get(pathName string, version int) (*Yank, error) {
+	res, err := y.forPaths([]string{pathName})
+	if err != nil {
+		return nil, err
+	}
+	return res[versionKey{pathName, version}], nil
+}
+
+// Gets the yanks of the given files by version.
+func (y *Yanks) forPaths(paths []string) (res map[versionKey]*Yank,
+	err error) {
+	res = map[versionKey]*Yank{}
+	query := "select PathName, VersionNum, Reason, Replacement, " +
+		"Principal, Created from yanks where PathName in (?" +
+		strings.Repeat(", ?", len(paths)-1) + ")"
+	args := make([]interface{}, len(paths))
+	for i, pathName := range paths {
+		args[i] = pathName
+	}
+	spanCtx, end := querySpan(y.ctx, "yanks", query)
+	defer func() { end(err) }()
+	rows, err := y.ctx.Db.QueryContext(spanCtx, query, args...)
+	if err != nil {
+		return res, dbError("Couldn't query yanks.", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		yank := Yank{}
+		var replacement sql.NullInt64
+		err = rows.Scan(&yank.Path, &yank.Version, &yank.Reason,
+			&replacement, &yank.Principal, &yank.Created)
+		if err != nil {
+			return res, dbError("Error reading yanks.", err)
+		}
+		yank.Replacement = int(replacement.Int64)
+		res[versionKey{yank.Path, yank.Version}] = &yank
+	}
+	if err = rows.Err(); err != nil {
+		err = dbError("Error reading yanks.", err)
+	}
+	return res, err
+}
+
+// Gets the SQL condition that leaves out yanked versions from at-time
+// resolution, unless the request includes them. table names the entries
+// table in the query.
+func notYanked(ctx *utils.Context, table string) string {
+	if ctx.IncludeYanked {
+		return ""
+	}
+	return " and not exists (select 1 from yanks where " +
+		"yanks.PathName = " + table + ".PathName and " +
+		"yanks.VersionNum = " + table + ".VersionNum)"
+}
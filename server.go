@@ -1,48 +1,106 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"log"
+	"log/slog"
 	"ncbi-tool-server/controllers"
+	"ncbi-tool-server/ftp"
+	"ncbi-tool-server/models"
 	"ncbi-tool-server/utils"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
-// General setup procedure
 func main() {
+	os.Exit(serve())
+}
+
+// General setup procedure. Runs the server until it's told to stop, and
+// gets the exit status once everything is closed: 1 if the server
+// couldn't start or a listener failed.
+func serve() int {
 	// Setup
-	log.SetOutput(os.Stderr)
-	log.SetOutput(os.Stdout)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	conf, err := utils.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := utils.NewLogger(conf.Log, os.Stdout)
+	slog.SetDefault(logger)
+	logger.Info("Loaded configuration.", "config", conf.String())
 	ctx := utils.NewContext()
-	ctx.Bucket = os.Getenv("BUCKET")
-	ctx.Port = "80"
-	if os.Getenv("PORT") != "" {
-		ctx.Port = os.Getenv("PORT")
+	ctx.Config = conf
+	ctx.Log = logger
+	ctx.Bucket = conf.Bucket
+	shutdownTracing, err := utils.SetupTracing(conf.Tracing, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if traceErr := shutdownTracing(context.Background()); traceErr != nil {
+			logger.Error("Couldn't flush traces.", "error", traceErr)
+		}
+	}()
+	ctx.Store = utils.TracedStore{
+		S3API: s3.New(session.Must(session.NewSession())),
+	}
+	if conf.Signing.Signer == "cloudfront" {
+		if ctx.Signer, err = utils.NewCloudFrontSigner(
+			conf.Signing.CloudFront); err != nil {
+			log.Fatal("Couldn't load CloudFront key: " + err.Error())
+		}
 	}
-	ctx.Store = s3.New(session.Must(session.NewSession()))
-	var err error
 	ctx.SetupDatabase()
 	defer func() {
 		closeErr := ctx.Db.Close()
 		if closeErr != nil {
-			err = utils.NewErr("Couldn't close db.", closeErr)
-			log.Println(err)
+			logger.Error("Couldn't close db.", "error", closeErr)
 		}
 	}()
+	if err = models.SetupTables(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	ctx.JobsCtx = jobsCtx
 
 	// Routing
 	router := mux.NewRouter()
+	router.Use(controllers.RecordRoute, controllers.Authenticate(ctx))
 	fileController := controllers.NewFileController(ctx)
 	fileController.Register(router)
 	directoryController := controllers.NewDirectoryController(ctx)
 	directoryController.Register(router)
+	healthController := controllers.NewHealthController(ctx)
+	healthController.Register(router)
+	davController := controllers.NewDavController(ctx)
+	davController.Register(router)
+	s3Controller := controllers.NewS3Controller(ctx)
+	s3Controller.Register(router)
+	browseController := controllers.NewBrowseController(ctx)
+	browseController.Register(router)
+	mementoController := controllers.NewMementoController(ctx)
+	mementoController.Register(router)
+	adminController := controllers.NewAdminController(ctx)
+	adminController.Register(router)
+	pinController := controllers.NewPinController(ctx)
+	pinController.Register(router)
+	openAPIController := controllers.NewOpenAPIController(ctx, router,
+		fileController, directoryController, healthController,
+		davController, s3Controller, browseController,
+		mementoController, adminController, pinController)
+	openAPIController.Register(router)
 	router.HandleFunc("/",
 		func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprint(w, "Welcome to the NCBI data tool.")
@@ -53,10 +111,111 @@ func main() {
 		})
 
 	// Start server
-	log.Print("Starting listener...")
-	err = http.ListenAndServe(":"+ctx.Port, router)
+	server := &http.Server{
+		Addr: ":" + conf.Port,
+		Handler: otelhttp.NewHandler(controllers.RequestLogger(ctx)(router),
+			"http.request"),
+		ReadHeaderTimeout: conf.Server.ReadHeaderTimeout.Duration,
+		ReadTimeout:       conf.Server.ReadTimeout.Duration,
+		WriteTimeout:      conf.Server.WriteTimeout.Duration,
+		IdleTimeout:       conf.Server.IdleTimeout.Duration,
+	}
+	useTLS := conf.TLS.CertFile != ""
+	if useTLS {
+		certs, tlsErr := utils.NewCertReloader(conf.TLS.CertFile,
+			conf.TLS.KeyFile, logger)
+		if tlsErr != nil {
+			logger.Error("Error in setting up TLS.", "error", tlsErr)
+			return 1
+		}
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+	serveErr := make(chan error, 2)
+	go func() {
+		logger.Info("Starting listener...", "port", conf.Port,
+			"tls", useTLS)
+		if useTLS {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+	var ftpServer *ftp.Server
+	if conf.FTP.Port != "" {
+		ftpServer = ftp.NewServer(ctx)
+		go func() {
+			serveErr <- ftpServer.ListenAndServe(":" + conf.FTP.Port)
+		}()
+	}
+
+	if conf.Retention.Interval.Duration > 0 {
+		go utils.Every(jobsCtx, conf.Retention.Interval.Duration,
+			func(runCtx context.Context) { collectGarbage(ctx, runCtx) })
+	}
+	if conf.Audit.Interval.Duration > 0 {
+		go utils.Every(jobsCtx, conf.Audit.Interval.Duration,
+			func(runCtx context.Context) { audit(ctx, runCtx) })
+	}
+
+	// Wait for a shutdown signal or a listener failure
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err = <-serveErr:
+		logger.Error("Error in running listen and serve.", "error", err)
+		return 1
+	case sig := <-stop:
+		logger.Info("Draining connections...", "signal", sig.String())
+	}
+
+	// Let in-flight requests finish before the deadline
+	stopJobs()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(),
+		conf.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error("Error in shutting down server.", "error", err)
+		err = server.Close()
+		if err != nil {
+			logger.Error("Error in closing server.", "error", err)
+		}
+	}
+	if ftpServer != nil {
+		err = ftpServer.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("Error in shutting down FTP.", "error", err)
+		}
+	}
+	logger.Info("Server stopped.")
+	return 0
+}
+
+// Runs scheduled garbage collection and logs its outcome.
+func collectGarbage(ctx *utils.Context, runCtx context.Context) {
+	jobCtx := *ctx
+	jobCtx.RequestCtx = runCtx
+	dryRun := ctx.Config.Retention.DryRun
+	report, err := models.NewRetention(&jobCtx).Collect("scheduler", dryRun)
+	if err != nil {
+		ctx.Log.Error("Garbage collection failed.", "error", err)
+		return
+	}
+	ctx.Log.Info("Garbage collection finished.", "run", report.RunID,
+		"dryRun", dryRun, "checked", report.Checked,
+		"deleted", len(report.Deleted), "protected", report.Protected,
+		"errors", len(report.Errors))
+}
+
+// Runs a scheduled integrity audit. The audit logs its own outcome.
+func audit(ctx *utils.Context, runCtx context.Context) {
+	jobCtx := *ctx
+	jobCtx.RequestCtx = runCtx
+	_, err := models.NewAudit(&jobCtx).Run(ctx.Config.Audit.Verify)
 	if err != nil {
-		log.Print(err.Error())
-		log.Fatal("Error in running listen and serve.")
+		ctx.Log.Error("Audit failed.", "error", err)
 	}
 }
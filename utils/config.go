@@ -0,0 +1,826 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted replaces secret values in logged output
+const redacted = "[REDACTED]"
+
+// maxPresignTTL is the longest lifetime S3 allows for a presigned URL
+const maxPresignTTL = 7 * 24 * time.Hour
+
+// Config contains all server settings. Values are resolved in order of
+// increasing precedence: built-in defaults, the JSON config file, environment
+// variables, then command-line flags.
+type Config struct {
+	Environment string
+	Port        string
+	Bucket      string
+	DB          DBConfig
+	TLS         TLSConfig
+	Server      ServerConfig
+	// PresignTTL is how long generated download URLs stay valid
+	PresignTTL Duration
+	Signing    SigningConfig
+	Cache      CacheConfig
+	Query      QueryConfig
+	Auth       AuthConfig
+	Log        LogConfig
+	Tracing    TracingConfig
+	FTP        FTPConfig
+	Download   DownloadConfig
+	Retention  RetentionConfig
+	Cold       ColdStorageConfig
+	Audit      AuditConfig
+}
+
+// DBConfig contains database connection settings
+type DBConfig struct {
+	Host     string
+	Port     string
+	Name     string
+	Username string
+	Password string
+	// PasswordFile is read into Password if set
+	PasswordFile string
+}
+
+// TLSConfig contains the certificate files to serve HTTPS with. TLS is
+// served only if both files are set.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ServerConfig contains the HTTP server timeouts
+type ServerConfig struct {
+	ReadHeaderTimeout Duration
+	ReadTimeout       Duration
+	WriteTimeout      Duration
+	IdleTimeout       Duration
+	ShutdownTimeout   Duration
+}
+
+// CacheConfig contains client caching settings. MaxAge is sent as the
+// Cache-Control max-age for responses about past points in time, which
+// don't change. Zero disables caching.
+type CacheConfig struct {
+	MaxAge Duration
+}
+
+// QueryConfig contains database query limits. Timeout bounds each query
+// made while serving a request, and RouteTimeouts overrides it for routes
+// by path template, like "/directory/at-time". Zero means no limit.
+type QueryConfig struct {
+	Timeout       Duration
+	RouteTimeouts map[string]Duration
+}
+
+// AuthConfig contains API token settings. TokensFile has one
+// "principal:token" pair per line.
+type AuthConfig struct {
+	Required   bool
+	TokensFile string
+	// Tokens maps each token to its principal. Loaded from TokensFile.
+	Tokens map[string]string `json:"-"`
+	// Admins are the principals allowed to use the /admin endpoints
+	Admins []string
+}
+
+// LogConfig contains logging settings
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+// TracingConfig contains OpenTelemetry settings. Exporter is "none",
+// "stdout" or "otlp". The OTLP endpoint can also be set with the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT variable.
+type TracingConfig struct {
+	Exporter    string
+	Endpoint    string
+	SampleRatio float64
+	ServiceName string
+}
+
+// SigningConfig contains download URL settings. Signer is "s3" for
+// presigned S3 URLs or "cloudfront" for CloudFront signed URLs. MaxTTL
+// bounds the expires-in a client may ask for.
+type SigningConfig struct {
+	Signer     string
+	MaxTTL     Duration
+	CloudFront CloudFrontConfig
+}
+
+// CloudFrontConfig contains the distribution and key pair to sign
+// CloudFront URLs with. If Cookies is set, /download authorizes clients
+// with signed cookies for CookieDomain instead of signing the URL.
+type CloudFrontConfig struct {
+	Domain         string
+	KeyPairID      string
+	PrivateKeyFile string
+	Cookies        bool
+	CookieDomain   string
+}
+
+// RetentionConfig contains the rules for garbage collecting archived
+// versions. Each version is checked against the first rule whose Pattern
+// matches its path, and versions of paths no rule matches are kept.
+// Versions that were current at one of the Snapshots times, or are
+// pinned, are always kept. Interval is how often the GC job runs, and zero
+// means it only runs when asked through /admin/gc. If DryRun is set, the
+// scheduled job only reports what it would delete.
+type RetentionConfig struct {
+	Rules     []RetentionRule
+	Snapshots []string
+	Interval  Duration
+	DryRun    bool
+}
+
+// RetentionRule says which versions of matching paths to keep. Pattern is
+// a glob like "/blast/db/*.tar.gz", where * doesn't match slashes. The
+// newest KeepLast versions are kept, along with the newest version of each
+// month for versions older than MonthlyAfter, if it's set.
+type RetentionRule struct {
+	Pattern      string
+	KeepLast     int
+	MonthlyAfter Duration
+}
+
+// ColdStorageConfig contains settings for archived versions that lifecycle
+// rules moved to cold storage classes like GLACIER. If Check is set, the
+// storage class of archived versions is looked up before handing out
+// URLs. Restores keep a copy downloadable for RestoreDays and use
+// RestoreTier: Expedited, Standard or Bulk.
+type ColdStorageConfig struct {
+	Check       bool
+	RestoreDays int
+	RestoreTier string
+}
+
+// maxAuditRate bounds Audit.RequestsPerSecond, so that the audit's pace
+// is a usable ticker interval
+const maxAuditRate = 10000
+
+// AuditConfig contains settings for the integrity audit, which checks that
+// every entry has its object and every archived object has its entry.
+// Entries are read PageSize at a time and looked up by Workers at once, at
+// most RequestsPerSecond in total. Interval is how often the audit runs,
+// and zero means it only runs when asked. If Verify is set, object sizes
+// and ETags are compared with those recorded by earlier audits, which
+// trust each object the first time they see it.
+type AuditConfig struct {
+	Interval          Duration
+	Workers           int
+	RequestsPerSecond int
+	PageSize          int
+	Verify            bool
+}
+
+// DownloadConfig contains settings for the /download endpoint. Mode
+// "redirect" sends clients to a presigned URL, and "proxy" streams the
+// object through the server.
+type DownloadConfig struct {
+	Mode string
+}
+
+// FTPConfig contains settings for the read-only FTP front end, which only
+// runs if Port is set. Data connections are passive only, on a port from
+// PassivePorts, a range like "30000-30009", or any free port if it's
+// empty. PublicHost is the IPv4 address sent in PASV replies, for servers
+// behind NAT. It defaults to the address the client connected to.
+type FTPConfig struct {
+	Port         string
+	PassivePorts string
+	PublicHost   string
+}
+
+// PassiveRange parses PassivePorts. Returns zeros if it's empty.
+func (c FTPConfig) PassiveRange() (int, int, error) {
+	if c.PassivePorts == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(c.PassivePorts, "-", 2)
+	first, err := strconv.Atoi(parts[0])
+	last := first
+	if err == nil && len(parts) == 2 {
+		last, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, errors.New("invalid FTP passive port range " +
+			c.PassivePorts)
+	}
+	return first, last, nil
+}
+
+// Principal finds the principal for a token, or returns "" if the token
+// is unknown. Compares against every token in constant time so that
+// response timing doesn't leak token prefixes.
+func (c AuthConfig) Principal(token string) string {
+	res := ""
+	for known, principal := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			res = principal
+		}
+	}
+	return res
+}
+
+// Duration is a time.Duration that reads and writes as a string like "1h"
+// in JSON.
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON formats the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	res, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = res
+	return nil
+}
+
+// DefaultConfig returns the built-in default settings
+func DefaultConfig() *Config {
+	return &Config{
+		Environment: "production",
+		Port:        "80",
+		DB: DBConfig{
+			Port: "3306",
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: Duration{10 * time.Second},
+			ReadTimeout:       Duration{30 * time.Second},
+			// Generous so that large streamed responses aren't cut off
+			WriteTimeout:    Duration{30 * time.Minute},
+			IdleTimeout:     Duration{2 * time.Minute},
+			ShutdownTimeout: Duration{30 * time.Second},
+		},
+		PresignTTL: Duration{time.Hour},
+		Signing: SigningConfig{
+			Signer: "s3",
+			MaxTTL: Duration{12 * time.Hour},
+		},
+		Query: QueryConfig{
+			Timeout:       Duration{30 * time.Second},
+			RouteTimeouts: map[string]Duration{},
+		},
+		Auth: AuthConfig{
+			Tokens: map[string]string{},
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+			ServiceName: "ncbi-tool-server",
+		},
+		Cold: ColdStorageConfig{
+			RestoreDays: 7,
+			RestoreTier: "Standard",
+		},
+		Audit: AuditConfig{
+			Workers:           8,
+			RequestsPerSecond: 50,
+			PageSize:          1000,
+		},
+		Download: DownloadConfig{
+			Mode: "redirect",
+		},
+	}
+}
+
+// A setting that can be given as an environment variable or a flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{"environment", "ENVIRONMENT", "deployment environment",
+		func(c *Config, v string) error { c.Environment = v; return nil }},
+	{"port", "PORT", "port to listen on",
+		func(c *Config, v string) error { c.Port = v; return nil }},
+	{"bucket", "BUCKET", "S3 bucket with the mirrored files",
+		func(c *Config, v string) error { c.Bucket = v; return nil }},
+	{"db-host", "RDS_HOSTNAME", "database host",
+		func(c *Config, v string) error { c.DB.Host = v; return nil }},
+	{"db-port", "RDS_PORT", "database port",
+		func(c *Config, v string) error { c.DB.Port = v; return nil }},
+	{"db-name", "RDS_DB_NAME", "database name",
+		func(c *Config, v string) error { c.DB.Name = v; return nil }},
+	{"db-username", "RDS_USERNAME", "database username",
+		func(c *Config, v string) error { c.DB.Username = v; return nil }},
+	{"", "RDS_PASSWORD", "",
+		func(c *Config, v string) error { c.DB.Password = v; return nil }},
+	{"db-password-file", "RDS_PASSWORD_FILE", "file with the database password",
+		func(c *Config, v string) error { c.DB.PasswordFile = v; return nil }},
+	{"tls-cert-file", "TLS_CERT_FILE", "TLS certificate file",
+		func(c *Config, v string) error { c.TLS.CertFile = v; return nil }},
+	{"tls-key-file", "TLS_KEY_FILE", "TLS key file",
+		func(c *Config, v string) error { c.TLS.KeyFile = v; return nil }},
+	{"read-timeout", "READ_TIMEOUT", "server read timeout",
+		durationSetter(func(c *Config) *Duration { return &c.Server.ReadTimeout })},
+	{"write-timeout", "WRITE_TIMEOUT", "server write timeout",
+		durationSetter(func(c *Config) *Duration { return &c.Server.WriteTimeout })},
+	{"idle-timeout", "IDLE_TIMEOUT", "server idle timeout",
+		durationSetter(func(c *Config) *Duration { return &c.Server.IdleTimeout })},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "time allowed to drain requests on shutdown",
+		durationSetter(func(c *Config) *Duration { return &c.Server.ShutdownTimeout })},
+	{"presign-ttl", "PRESIGN_TTL", "lifetime of download URLs",
+		durationSetter(func(c *Config) *Duration { return &c.PresignTTL })},
+	{"max-presign-ttl", "MAX_PRESIGN_TTL", "longest expires-in a client may ask for",
+		durationSetter(func(c *Config) *Duration { return &c.Signing.MaxTTL })},
+	{"url-signer", "URL_SIGNER", "how download URLs are signed: s3 or cloudfront",
+		func(c *Config, v string) error { c.Signing.Signer = v; return nil }},
+	{"cloudfront-domain", "CLOUDFRONT_DOMAIN", "CloudFront distribution domain",
+		func(c *Config, v string) error { c.Signing.CloudFront.Domain = v; return nil }},
+	{"cloudfront-key-pair-id", "CLOUDFRONT_KEY_PAIR_ID", "CloudFront key pair ID",
+		func(c *Config, v string) error { c.Signing.CloudFront.KeyPairID = v; return nil }},
+	{"cloudfront-private-key-file", "CLOUDFRONT_PRIVATE_KEY_FILE", "PEM file with the CloudFront private key",
+		func(c *Config, v string) error { c.Signing.CloudFront.PrivateKeyFile = v; return nil }},
+	{"cloudfront-cookies", "CLOUDFRONT_COOKIES", "authorize downloads with signed cookies",
+		func(c *Config, v string) error {
+			res, err := strconv.ParseBool(v)
+			c.Signing.CloudFront.Cookies = res
+			return err
+		}},
+	{"cloudfront-cookie-domain", "CLOUDFRONT_COOKIE_DOMAIN", "domain for signed cookies",
+		func(c *Config, v string) error { c.Signing.CloudFront.CookieDomain = v; return nil }},
+	{"cache-max-age", "CACHE_MAX_AGE", "Cache-Control max-age for past-time responses",
+		durationSetter(func(c *Config) *Duration { return &c.Cache.MaxAge })},
+	{"query-timeout", "QUERY_TIMEOUT", "time limit for each database query",
+		durationSetter(func(c *Config) *Duration { return &c.Query.Timeout })},
+	{"route-query-timeouts", "ROUTE_QUERY_TIMEOUTS",
+		"per-route query time limits, e.g. /directory/at-time=2m,/file=5s",
+		func(c *Config, v string) error {
+			if c.Query.RouteTimeouts == nil {
+				c.Query.RouteTimeouts = map[string]Duration{}
+			}
+			for _, pair := range strings.Split(v, ",") {
+				parts := strings.SplitN(pair, "=", 2)
+				if len(parts) != 2 {
+					return errors.New("expected route=duration, got " + pair)
+				}
+				res, err := time.ParseDuration(parts[1])
+				if err != nil {
+					return err
+				}
+				c.Query.RouteTimeouts[strings.TrimSpace(parts[0])] =
+					Duration{res}
+			}
+			return nil
+		}},
+	{"auth-required", "AUTH_REQUIRED", "require an API token",
+		func(c *Config, v string) error {
+			res, err := strconv.ParseBool(v)
+			c.Auth.Required = res
+			return err
+		}},
+	{"auth-tokens-file", "AUTH_TOKENS_FILE", "file of principal:token lines",
+		func(c *Config, v string) error { c.Auth.TokensFile = v; return nil }},
+	{"auth-admins", "AUTH_ADMINS", "comma-separated principals allowed to use /admin",
+		func(c *Config, v string) error {
+			c.Auth.Admins = nil
+			for _, principal := range strings.Split(v, ",") {
+				if principal = strings.TrimSpace(principal); principal != "" {
+					c.Auth.Admins = append(c.Auth.Admins, principal)
+				}
+			}
+			return nil
+		}},
+	{"retention-interval", "RETENTION_INTERVAL", "how often to garbage collect old versions, off if 0",
+		durationSetter(func(c *Config) *Duration { return &c.Retention.Interval })},
+	{"retention-dry-run", "RETENTION_DRY_RUN", "only report what scheduled garbage collection would delete",
+		func(c *Config, v string) error {
+			res, err := strconv.ParseBool(v)
+			c.Retention.DryRun = res
+			return err
+		}},
+	{"log-level", "LOG_LEVEL", "log level: debug, info, warn or error",
+		func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"log-format", "LOG_FORMAT", "log format: text or json",
+		func(c *Config, v string) error { c.Log.Format = v; return nil }},
+	{"tracing-exporter", "TRACING_EXPORTER", "trace exporter: none, stdout or otlp",
+		func(c *Config, v string) error { c.Tracing.Exporter = v; return nil }},
+	{"tracing-endpoint", "TRACING_ENDPOINT", "OTLP/HTTP collector URL",
+		func(c *Config, v string) error { c.Tracing.Endpoint = v; return nil }},
+	{"ftp-port", "FTP_PORT", "port for the read-only FTP front end, off if empty",
+		func(c *Config, v string) error { c.FTP.Port = v; return nil }},
+	{"ftp-passive-ports", "FTP_PASSIVE_PORTS", "FTP data port range, e.g. 30000-30009",
+		func(c *Config, v string) error { c.FTP.PassivePorts = v; return nil }},
+	{"ftp-public-host", "FTP_PUBLIC_HOST", "IPv4 address sent in FTP PASV replies",
+		func(c *Config, v string) error { c.FTP.PublicHost = v; return nil }},
+	{"download-mode", "DOWNLOAD_MODE", "how /download serves files: redirect or proxy",
+		func(c *Config, v string) error { c.Download.Mode = v; return nil }},
+	{"cold-storage-check", "COLD_STORAGE_CHECK", "look up storage classes of archived versions before signing URLs",
+		func(c *Config, v string) error {
+			res, err := strconv.ParseBool(v)
+			c.Cold.Check = res
+			return err
+		}},
+	{"restore-days", "RESTORE_DAYS", "days restored versions stay downloadable",
+		func(c *Config, v string) error {
+			res, err := strconv.Atoi(v)
+			c.Cold.RestoreDays = res
+			return err
+		}},
+	{"restore-tier", "RESTORE_TIER", "restore tier: Expedited, Standard or Bulk",
+		func(c *Config, v string) error { c.Cold.RestoreTier = v; return nil }},
+	{"audit-interval", "AUDIT_INTERVAL", "how often to audit entries against stored objects, off if 0",
+		durationSetter(func(c *Config) *Duration { return &c.Audit.Interval })},
+	{"audit-workers", "AUDIT_WORKERS", "objects the audit looks up at once",
+		func(c *Config, v string) error {
+			res, err := strconv.Atoi(v)
+			c.Audit.Workers = res
+			return err
+		}},
+	{"audit-rate", "AUDIT_RATE", "most object lookups per second during an audit",
+		func(c *Config, v string) error {
+			res, err := strconv.Atoi(v)
+			c.Audit.RequestsPerSecond = res
+			return err
+		}},
+	{"audit-verify", "AUDIT_VERIFY", "compare object sizes and ETags with earlier audits",
+		func(c *Config, v string) error {
+			res, err := strconv.ParseBool(v)
+			c.Audit.Verify = res
+			return err
+		}},
+	{"tracing-sample-ratio", "TRACING_SAMPLE_RATIO", "fraction of new traces to sample",
+		func(c *Config, v string) error {
+			res, err := strconv.ParseFloat(v, 64)
+			c.Tracing.SampleRatio = res
+			return err
+		}},
+}
+
+// Returns a setter that parses a duration into the given field.
+func durationSetter(field func(c *Config) *Duration) func(c *Config,
+	v string) error {
+	return func(c *Config, v string) error {
+		res, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		field(c).Duration = res
+		return nil
+	}
+}
+
+// LoadConfig resolves the configuration from the defaults, the config file
+// named by -config or CONFIG_FILE, the environment and the given
+// command-line arguments, then reads secret files and validates the result.
+func LoadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("ncbi-tool-server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"),
+		"JSON config file")
+	flagValues := map[string]*string{}
+	for _, s := range settings {
+		if s.flag != "" {
+			flagValues[s.flag] = fs.String(s.flag, "", s.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	conf := DefaultConfig()
+	if *configFile != "" {
+		if err := conf.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(conf, v); err != nil {
+				return nil, NewErr("Invalid value for "+s.env+".", err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if setErr := s.set(conf, *flagValues[s.flag]); setErr != nil {
+					err = NewErr("Invalid value for -"+s.flag+".", setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conf.applyDevelopmentDefaults()
+	if err = conf.readSecrets(); err != nil {
+		return nil, err
+	}
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Reads settings from a JSON file over the current values.
+func (c *Config) loadFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return NewErr("Couldn't read config file.", err)
+	}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return NewErr("Couldn't parse config file "+name+".", err)
+	}
+	return nil
+}
+
+// Fills in local database settings for development if they weren't given.
+// The default credentials are those of the local development database.
+func (c *Config) applyDevelopmentDefaults() {
+	if c.Environment != "development" {
+		return
+	}
+	if c.DB.Host == "" {
+		c.DB.Host = "127.0.0.1"
+	}
+	if c.DB.Name == "" {
+		c.DB.Name = "testdb"
+	}
+	if c.DB.Username == "" {
+		c.DB.Username = "dev"
+		if c.DB.Password == "" && c.DB.PasswordFile == "" {
+			c.DB.Password = "password"
+		}
+	}
+}
+
+// Reads secrets that were given as files.
+func (c *Config) readSecrets() error {
+	if c.DB.PasswordFile != "" {
+		res, err := readSecretFile(c.DB.PasswordFile)
+		if err != nil {
+			return err
+		}
+		c.DB.Password = res
+	}
+	if c.Auth.TokensFile != "" {
+		res, err := readTokensFile(c.Auth.TokensFile)
+		if err != nil {
+			return err
+		}
+		c.Auth.Tokens = res
+	}
+	return nil
+}
+
+// Reads a secret value from a file, without surrounding whitespace.
+func readSecretFile(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", NewErr("Couldn't read secret file.", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Reads a file of "principal:token" lines into a token -> principal map.
+// Blank lines and lines starting with # are skipped.
+func readTokensFile(name string) (map[string]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, NewErr("Couldn't open tokens file.", err)
+	}
+	defer file.Close()
+
+	res := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed line %d in tokens file %s",
+				num, name)
+		}
+		res[parts[1]] = parts[0]
+	}
+	return res, scanner.Err()
+}
+
+// Validate checks that the settings are complete and consistent
+func (c *Config) Validate() error {
+	problems := []string{}
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 ||
+		port > 65535 {
+		add("invalid port %q", c.Port)
+	}
+	if c.Bucket == "" {
+		add("bucket is required")
+	}
+	if c.DB.Host == "" || c.DB.Name == "" || c.DB.Username == "" {
+		add("database host, name and username are required")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		add("TLS needs both a cert file and a key file")
+	}
+	timeouts := map[string]Duration{
+		"read header timeout": c.Server.ReadHeaderTimeout,
+		"read timeout":        c.Server.ReadTimeout,
+		"write timeout":       c.Server.WriteTimeout,
+		"idle timeout":        c.Server.IdleTimeout,
+		"shutdown timeout":    c.Server.ShutdownTimeout,
+	}
+	timeouts["query timeout"] = c.Query.Timeout
+	for route, val := range c.Query.RouteTimeouts {
+		timeouts["query timeout for "+route] = val
+	}
+	for name, val := range timeouts {
+		if val.Duration < 0 {
+			add("%s must not be negative", name)
+		}
+	}
+	if c.PresignTTL.Duration < time.Second ||
+		c.PresignTTL.Duration > maxPresignTTL {
+		add("presign TTL must be between 1s and %s", maxPresignTTL)
+	}
+	if c.Signing.MaxTTL.Duration < c.PresignTTL.Duration {
+		add("max presign TTL must be at least the presign TTL")
+	}
+	switch c.Signing.Signer {
+	case "s3":
+		if c.Signing.MaxTTL.Duration > maxPresignTTL {
+			add("max presign TTL must be at most %s", maxPresignTTL)
+		}
+	case "cloudfront":
+		cf := c.Signing.CloudFront
+		if cf.Domain == "" || cf.KeyPairID == "" || cf.PrivateKeyFile == "" {
+			add("CloudFront signing needs a domain, key pair ID and " +
+				"private key file")
+		}
+	default:
+		add("invalid URL signer %q", c.Signing.Signer)
+	}
+	if c.Cache.MaxAge.Duration < 0 ||
+		c.Cache.MaxAge.Duration >= c.PresignTTL.Duration {
+		// Cached responses would contain expired URLs
+		add("cache max age must be between 0 and the presign TTL")
+	}
+	if c.Auth.Required && len(c.Auth.Tokens) == 0 {
+		add("auth is required but no tokens are configured")
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		add("invalid log level %q", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		add("invalid log format %q", c.Log.Format)
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		add("invalid trace exporter %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("trace sample ratio must be between 0 and 1")
+	}
+	switch c.Download.Mode {
+	case "redirect", "proxy":
+	default:
+		add("invalid download mode %q", c.Download.Mode)
+	}
+	if c.Cold.RestoreDays < 1 {
+		add("restore days must be at least 1")
+	}
+	switch c.Cold.RestoreTier {
+	case "Expedited", "Standard", "Bulk":
+	default:
+		add("invalid restore tier %q", c.Cold.RestoreTier)
+	}
+	if c.Audit.Interval.Duration < 0 {
+		add("audit interval must not be negative")
+	}
+	if c.Audit.Workers < 1 || c.Audit.RequestsPerSecond < 1 ||
+		c.Audit.PageSize < 1 {
+		add("audit workers, rate and page size must be at least 1")
+	}
+	if c.Audit.RequestsPerSecond > maxAuditRate {
+		add("audit rate must be at most %d per second", maxAuditRate)
+	}
+	if c.Retention.Interval.Duration < 0 {
+		add("retention interval must not be negative")
+	}
+	for _, rule := range c.Retention.Rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil ||
+			!strings.HasPrefix(rule.Pattern, "/") {
+			add("invalid retention pattern %q", rule.Pattern)
+		}
+		if rule.KeepLast < 1 {
+			add("retention rule %q must keep at least 1 version",
+				rule.Pattern)
+		}
+		if rule.MonthlyAfter.Duration < 0 {
+			add("retention rule %q has a negative monthly-after",
+				rule.Pattern)
+		}
+	}
+	for _, snapshot := range c.Retention.Snapshots {
+		if _, err := ParsePointInTime(snapshot); err != nil ||
+			snapshot == "latest" {
+			add("invalid retention snapshot time %q", snapshot)
+		}
+	}
+	if c.FTP.Port != "" {
+		if port, err := strconv.Atoi(c.FTP.Port); err != nil || port < 1 ||
+			port > 65535 {
+			add("invalid FTP port %q", c.FTP.Port)
+		}
+	}
+	if _, _, err := c.FTP.PassiveRange(); err != nil {
+		add("%s", err)
+	}
+	if c.FTP.PublicHost != "" {
+		if ip := net.ParseIP(c.FTP.PublicHost); ip == nil || ip.To4() == nil {
+			add("FTP public host must be an IPv4 address")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration: " +
+			strings.Join(problems, "; ") + ".")
+	}
+	return nil
+}
+
+// QueryTimeoutFor returns the time limit for each query made while
+// serving the route with the given path template
+func (c *Config) QueryTimeoutFor(route string) time.Duration {
+	if res, ok := c.Query.RouteTimeouts[route]; ok {
+		return res.Duration
+	}
+	return c.Query.Timeout.Duration
+}
+
+// DSN returns the database connection string
+func (c *Config) DSN() string {
+	return c.dsn(c.DB.Password)
+}
+
+// RedactedDSN returns the database connection string safe for logging
+func (c *Config) RedactedDSN() string {
+	return c.dsn(redacted)
+}
+
+func (c *Config) dsn(password string) string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", c.DB.Username, password,
+		c.DB.Host, c.DB.Port, c.DB.Name)
+}
+
+// String formats the settings as JSON with secrets redacted
+func (c *Config) String() string {
+	res := *c
+	if res.DB.Password != "" {
+		res.DB.Password = redacted
+	}
+	js, err := json.Marshal(res)
+	if err != nil {
+		return "Couldn't format config. " + err.Error()
+	}
+	return string(js)
+}
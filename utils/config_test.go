@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a file in a temporary directory and returns its path.
+func writeTemp(t *testing.T, dir string, name string, data string) string {
+	res := filepath.Join(dir, name)
+	err := ioutil.WriteFile(res, []byte(data), 0600)
+	assert.Nil(t, err)
+	return res
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := writeTemp(t, dir, "config.json", `{"Port": "8000",
+		"Bucket": "from-file", "PresignTTL": "2h",
+		"DB": {"Host": "db", "Name": "ncbi", "Username": "reader"}}`)
+	os.Setenv("BUCKET", "from-env")
+	os.Setenv("PORT", "8001")
+	defer os.Unsetenv("BUCKET")
+	defer os.Unsetenv("PORT")
+
+	conf, err := LoadConfig([]string{"-config", file, "-port", "8002"})
+	assert.Nil(t, err)
+	assert.Equal(t, "8002", conf.Port)
+	assert.Equal(t, "from-env", conf.Bucket)
+	assert.Equal(t, 2*time.Hour, conf.PresignTTL.Duration)
+	assert.Equal(t, "3306", conf.DB.Port)
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	password := writeTemp(t, dir, "password", "hunter2\n")
+	tokens := writeTemp(t, dir, "tokens", "# comment\nalice:abc123\n")
+
+	conf, err := LoadConfig([]string{"-bucket", "b", "-db-host", "db",
+		"-db-name", "ncbi", "-db-username", "reader",
+		"-db-password-file", password, "-auth-tokens-file", tokens,
+		"-auth-required", "true"})
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", conf.DB.Password)
+	assert.Equal(t, "reader:hunter2@tcp(db:3306)/ncbi", conf.DSN())
+	assert.Equal(t, "alice", conf.Auth.Tokens["abc123"])
+	assert.False(t, strings.Contains(conf.String(), "hunter2"))
+	assert.False(t, strings.Contains(conf.String(), "abc123"))
+	assert.False(t, strings.Contains(conf.RedactedDSN(), "hunter2"))
+}
+
+func TestDevelopmentDefaults(t *testing.T) {
+	conf, err := LoadConfig([]string{"-bucket", "b",
+		"-environment", "development"})
+	assert.Nil(t, err)
+	assert.Equal(t, "dev:password@tcp(127.0.0.1:3306)/testdb", conf.DSN())
+
+	conf, err = LoadConfig([]string{"-bucket", "b",
+		"-environment", "development", "-db-username", "reader"})
+	assert.Nil(t, err)
+	assert.Equal(t, "reader:@tcp(127.0.0.1:3306)/testdb", conf.DSN())
+}
+
+func TestValidate(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Port = "http"
+	conf.TLS.CertFile = "cert.pem"
+	conf.Cache.MaxAge = Duration{2 * time.Hour}
+	conf.Audit.RequestsPerSecond = 2000000000
+	err := conf.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `invalid port "http"`)
+	assert.Contains(t, err.Error(), "bucket is required")
+	assert.Contains(t, err.Error(), "TLS needs both")
+	assert.Contains(t, err.Error(), "cache max age")
+	assert.Contains(t, err.Error(), "audit rate must be at most")
+}
+
+func TestQueryTimeoutFor(t *testing.T) {
+	conf, err := LoadConfig([]string{"-bucket", "b", "-db-host", "db",
+		"-db-name", "ncbi", "-db-username", "reader",
+		"-query-timeout", "5s",
+		"-route-query-timeouts", "/directory/at-time=2m,/file=1s"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Minute, conf.QueryTimeoutFor("/directory/at-time"))
+	assert.Equal(t, time.Second, conf.QueryTimeoutFor("/file"))
+	assert.Equal(t, 5*time.Second, conf.QueryTimeoutFor("/file/history"))
+}
+
+func TestAuthPrincipal(t *testing.T) {
+	auth := AuthConfig{Tokens: map[string]string{"secret": "alice"}}
+	assert.Equal(t, "alice", auth.Principal("secret"))
+	assert.Equal(t, "", auth.Principal("secre"))
+	assert.Equal(t, "", auth.Principal(""))
+}
@@ -1,11 +1,14 @@
 package utils
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gorilla/mux"
 	"log"
-	"os"
+	"log/slog"
+	"net/http"
+	"time"
 )
 
 // Context contains general state variables for the server
@@ -13,53 +16,94 @@ type Context struct {
 	Db     *sql.DB
 	Bucket string
 	Store  s3iface.S3API
-	Port   string
+	// Signer makes download URLs. Defaults to presigning with Store.
+	Signer URLSigner
+	Config *Config
+	Log    *slog.Logger
+	// RequestCtx is the context of the request being served, if any. Spans
+	// and queries started by the models derive from it.
+	RequestCtx context.Context
+	// JobsCtx is canceled when the server shuts down. Background work that
+	// outlives its request stops with it.
+	JobsCtx context.Context
+	// QueryTimeout bounds each Db query made by the models. Zero means no
+	// limit.
+	QueryTimeout time.Duration
+	// URLOptions are the client's choices for download URLs
+	URLOptions URLOptions
+	// IncludeYanked makes at-time resolution consider yanked versions
+	IncludeYanked bool
 }
 
-// NewContext initializes new general state variables
+// NewContext initializes new general state variables with the default
+// configuration
 func NewContext() *Context {
-	ctx := Context{}
+	ctx := Context{
+		Config:     DefaultConfig(),
+		Log:        slog.Default(),
+		RequestCtx: context.Background(),
+		JobsCtx:    context.Background(),
+	}
 	return &ctx
 }
 
+// ForRequest returns a copy of the context scoped to the request. Its
+// logger is the one attached to the request, so that log records carry
+// its request ID, and its RequestCtx carries the request's trace and is
+// canceled if the client goes away. Queries get the route's timeout, and
+// yanked versions are only resolved with include-yanked=true.
+func (ctx *Context) ForRequest(r *http.Request) *Context {
+	res := *ctx
+	res.Log = LoggerFrom(r.Context(), ctx.Log)
+	res.RequestCtx = r.Context()
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+	}
+	res.QueryTimeout = ctx.Config.QueryTimeoutFor(route)
+	res.IncludeYanked = r.URL.Query().Get("include-yanked") == "true"
+	return &res
+}
+
+// URLSigner gets the signer for download URLs.
+func (ctx *Context) URLSigner() URLSigner {
+	if ctx.Signer != nil {
+		return ctx.Signer
+	}
+	return S3Signer{Store: ctx.Store, Bucket: ctx.Bucket}
+}
+
+// URLTTL gets how long download URLs made for the request stay valid.
+func (ctx *Context) URLTTL() time.Duration {
+	if ctx.URLOptions.ExpiresIn > 0 {
+		return ctx.URLOptions.ExpiresIn
+	}
+	return ctx.Config.PresignTTL.Duration
+}
+
 // SetupDatabase sets up the db and checks connection conditions
 func (ctx *Context) SetupDatabase() {
 	var err error
-	isDevelopment := os.Getenv("ENVIRONMENT") == "development"
-	if isDevelopment {
-		ctx.Db, err = sql.Open("mysql",
-			"dev:password@tcp(127.0.0.1:3306)/testdb")
-		if err != nil {
-			log.Fatal("Failed to set up database opener: " + err.Error())
-		}
+	ctx.Log.Info("Opening database.", "dsn", ctx.Config.RedactedDSN())
+	ctx.Db, err = sql.Open("mysql", ctx.Config.DSN())
+	if err != nil {
+		log.Fatal("Failed to set up database opener: " + err.Error())
+	}
+	if ctx.Config.Environment == "development" {
 		_, err = ctx.Db.Exec("create table if not exists entries")
 		if err != nil {
 			log.Fatal("Failed to create table entries: " + err.Error())
 		}
-	} else {
-		// Setup RDS db from env variables
-		rdsHostname := os.Getenv("RDS_HOSTNAME")
-		rdsPort := os.Getenv("RDS_PORT")
-		rdsDbName := os.Getenv("RDS_DB_NAME")
-		rdsUsername := os.Getenv("RDS_USERNAME")
-		rdsPassword := os.Getenv("RDS_PASSWORD")
-		sourceName := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
-			rdsUsername, rdsPassword, rdsHostname, rdsPort, rdsDbName)
-		log.Print("DB connection string: " + sourceName)
-		ctx.Db, err = sql.Open("mysql", sourceName)
-	}
-	if err != nil {
-		log.Print(err)
-		log.Fatal("Failed to set up database opener.")
 	}
 	err = ctx.Db.Ping()
 	if err != nil {
-		log.Print(err)
-		log.Fatal("Failed to ping database.")
+		log.Fatal("Failed to ping database: " + err.Error())
 	}
 	rows, err := ctx.Db.Query("show tables like 'entries'")
 	if err != nil || !rows.Next() {
 		log.Fatal("Table 'entries' does not exist.")
 	}
-	log.Print("Successfully connected database.")
+	ctx.Log.Info("Successfully connected database.")
 }
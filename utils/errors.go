@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"errors"
+)
+
+// ErrorKind classifies an error by what the client should make of it
+type ErrorKind int
+
+// Error kinds. Errors without a kind are internal.
+const (
+	KindInternal ErrorKind = iota
+	KindNotFound
+	KindInvalidArgument
+	KindUnavailable
+	KindForbidden
+	KindDeadlineExceeded
+	KindConflict
+	KindCanceled
+	KindUnauthorized
+)
+
+// Error is a domain error. Code is a stable machine-readable identifier
+// for the specific problem, like "file_not_found".
+type Error struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+	Err     error
+}
+
+// Error formats the message and the underlying cause, if any
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + " " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NotFound makes an error for something that doesn't exist
+func NotFound(code string, message string, cause error) error {
+	return &Error{KindNotFound, code, message, cause}
+}
+
+// InvalidArgument makes an error for a malformed or missing request value
+func InvalidArgument(code string, message string, cause error) error {
+	return &Error{KindInvalidArgument, code, message, cause}
+}
+
+// Unavailable makes an error for a failing upstream dependency, like the
+// database or the object store
+func Unavailable(code string, message string, cause error) error {
+	return &Error{KindUnavailable, code, message, cause}
+}
+
+// Unauthorized makes an error for a request that needs credentials it
+// didn't have
+func Unauthorized(code string, message string, cause error) error {
+	return &Error{KindUnauthorized, code, message, cause}
+}
+
+// Forbidden makes an error for an action the caller may not perform
+func Forbidden(code string, message string, cause error) error {
+	return &Error{KindForbidden, code, message, cause}
+}
+
+// DeadlineExceeded makes an error for work that didn't finish in the time
+// allowed, like a slow query
+func DeadlineExceeded(code string, message string, cause error) error {
+	return &Error{KindDeadlineExceeded, code, message, cause}
+}
+
+// Conflict makes an error for a request the resource isn't in a state
+// for, like downloading a version that must be restored first
+func Conflict(code string, message string, cause error) error {
+	return &Error{KindConflict, code, message, cause}
+}
+
+// Canceled makes an error for work stopped because the caller gave up on
+// it, like a client that disconnected
+func Canceled(code string, message string, cause error) error {
+	return &Error{KindCanceled, code, message, cause}
+}
+
+// KindOf returns the kind of the first domain error in err's chain, or
+// KindInternal if there is none
+func KindOf(err error) ErrorKind {
+	var res *Error
+	if errors.As(err, &res) {
+		return res.Kind
+	}
+	return KindInternal
+}
+
+// CodeOf returns the code of the first domain error in err's chain, or
+// "internal" if there is none
+func CodeOf(err error) string {
+	var res *Error
+	if errors.As(err, &res) {
+		return res.Code
+	}
+	return "internal"
+}
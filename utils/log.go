@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// Type for request context keys set by this package
+type contextKey string
+
+const (
+	requestIDKey contextKey = "request-id"
+	loggerKey    contextKey = "logger"
+)
+
+// NewLogger makes a leveled logger writing text or JSON records to out
+func NewLogger(conf LogConfig, out io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLevel(conf.Level)}
+	if conf.Format == "json" {
+		return slog.New(slog.NewJSONHandler(out, opts))
+	}
+	return slog.New(slog.NewTextHandler(out, opts))
+}
+
+// Converts a configured level name to a slog level. Defaults to info.
+func parseLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	res, _ := ctx.Value(requestIDKey).(string)
+	return res
+}
+
+// WithLogger returns a copy of ctx carrying a request-scoped logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// LoggerFrom returns the logger carried by ctx, or fallback if there is
+// none
+func LoggerFrom(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if res, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return res
+	}
+	return fallback
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// Every calls fn every interval until ctx is done. It blocks, so run it in
+// its own goroutine. A run that takes longer than interval delays the next
+// one rather than overlapping it.
+func Every(ctx context.Context, interval time.Duration,
+	fn func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn(ctx)
+		}
+	}
+}
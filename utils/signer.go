@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URLSigner makes time-limited download URLs for stored objects.
+// disposition is the Content-Disposition to download with, if the signer
+// supports it.
+type URLSigner interface {
+	SignURL(ctx context.Context, key string, expiresIn time.Duration,
+		disposition string) (string, error)
+}
+
+// CookieSigner is implemented by signers that can also authorize a
+// download with cookies, so the URL itself can stay unsigned.
+type CookieSigner interface {
+	SignCookies(key string, expiresIn time.Duration) (string,
+		[]*http.Cookie, error)
+}
+
+// URLOptions are a client's choices for the download URLs in a response
+type URLOptions struct {
+	// ExpiresIn is how long URLs stay valid. Zero means the server's
+	// PresignTTL.
+	ExpiresIn time.Duration
+	// Inline asks browsers to show files instead of saving them
+	Inline bool
+	// VersionedName puts the version number in the download filename
+	VersionedName bool
+}
+
+// S3Signer presigns S3 GetObject requests
+type S3Signer struct {
+	Store  s3iface.S3API
+	Bucket string
+}
+
+// SignURL presigns a GetObject request for key.
+func (s S3Signer) SignURL(ctx context.Context, key string,
+	expiresIn time.Duration, disposition string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+	if disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
+	}
+	req, _ := s.Store.GetObjectRequest(input)
+	req.SetContext(ctx)
+	return req.Presign(expiresIn)
+}
+
+// CloudFrontSigner makes CloudFront signed URLs and cookies with a canned
+// policy, using a key pair registered with the distribution. CloudFront
+// doesn't pass response overrides to the origin, so the disposition is
+// ignored.
+type CloudFrontSigner struct {
+	// Domain is the distribution's domain name, like
+	// d111111abcdef8.cloudfront.net
+	Domain    string
+	KeyPairID string
+	Key       *rsa.PrivateKey
+	// CookieDomain is the Domain attribute of signed cookies
+	CookieDomain string
+	// Now is the clock expiry times are counted from
+	Now func() time.Time
+}
+
+// NewCloudFrontSigner loads the private key for a CloudFrontSigner.
+func NewCloudFrontSigner(conf CloudFrontConfig) (*CloudFrontSigner, error) {
+	data, err := ioutil.ReadFile(conf.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + conf.PrivateKeyFile)
+	}
+	var key *rsa.PrivateKey
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		key, _ = parsed.(*rsa.PrivateKey)
+		if err == nil && key == nil {
+			err = errors.New("CloudFront keys must be RSA")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CloudFrontSigner{
+		Domain:       conf.Domain,
+		KeyPairID:    conf.KeyPairID,
+		Key:          key,
+		CookieDomain: conf.CookieDomain,
+		Now:          time.Now,
+	}, nil
+}
+
+// SignURL makes a signed URL for key.
+func (s *CloudFrontSigner) SignURL(ctx context.Context, key string,
+	expiresIn time.Duration, disposition string) (string, error) {
+	resource := s.resourceURL(key)
+	expires, signature, err := s.sign(resource, expiresIn)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("Expires", expires)
+	query.Set("Signature", signature)
+	query.Set("Key-Pair-Id", s.KeyPairID)
+	return resource + "?" + query.Encode(), nil
+}
+
+// SignCookies makes the signed cookies that authorize a download of key,
+// and returns the unsigned URL to download it from.
+func (s *CloudFrontSigner) SignCookies(key string,
+	expiresIn time.Duration) (string, []*http.Cookie, error) {
+	resource := s.resourceURL(key)
+	expires, signature, err := s.sign(resource, expiresIn)
+	if err != nil {
+		return "", nil, err
+	}
+	res := []*http.Cookie{}
+	for _, pair := range [][2]string{{"CloudFront-Expires", expires},
+		{"CloudFront-Signature", signature},
+		{"CloudFront-Key-Pair-Id", s.KeyPairID}} {
+		res = append(res, &http.Cookie{
+			Name:     pair[0],
+			Value:    pair[1],
+			Domain:   s.CookieDomain,
+			Path:     "/",
+			MaxAge:   int(expiresIn.Seconds()),
+			Secure:   true,
+			HttpOnly: true,
+		})
+	}
+	return resource, res, nil
+}
+
+// Makes the URL of key on the distribution.
+func (s *CloudFrontSigner) resourceURL(key string) string {
+	return (&url.URL{Scheme: "https", Host: s.Domain,
+		Path: "/" + strings.TrimPrefix(key, "/")}).String()
+}
+
+// CloudFront canned policy. Fields are in the order CloudFront expects.
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement
+}
+
+// A statement of a canned policy
+type cloudFrontStatement struct {
+	Resource  string
+	Condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		}
+	}
+}
+
+// Signs a canned policy for resource. Returns the expiry as a Unix time
+// and the signature, both as CloudFront wants them in URLs and cookies.
+func (s *CloudFrontSigner) sign(resource string,
+	expiresIn time.Duration) (string, string, error) {
+	statement := cloudFrontStatement{Resource: resource}
+	statement.Condition.DateLessThan.EpochTime = s.Now().Add(
+		expiresIn).Unix()
+	// CloudFront rebuilds the policy from the URL, so characters like &
+	// must be left as they are
+	var policy bytes.Buffer
+	enc := json.NewEncoder(&policy)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(cloudFrontPolicy{[]cloudFrontStatement{statement}})
+	if err != nil {
+		return "", "", err
+	}
+	expires := strconv.FormatInt(statement.Condition.DateLessThan.EpochTime,
+		10)
+	hash := sha1.Sum(bytes.TrimSuffix(policy.Bytes(), []byte("\n")))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.Key, crypto.SHA1, hash[:])
+	if err != nil {
+		return "", "", err
+	}
+	// CloudFront's URL-safe variant of base64
+	encoded := strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(
+		base64.StdEncoding.EncodeToString(sig))
+	return expires, encoded, nil
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloudFrontSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		0600))
+	signer, err := NewCloudFrontSigner(CloudFrontConfig{
+		Domain: "d111111abcdef8.cloudfront.net", KeyPairID: "APKAEXAMPLE",
+		PrivateKeyFile: keyFile})
+	assert.Nil(t, err)
+	signer.Now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	res, err := signer.SignURL(context.Background(), "/archive/README-1",
+		2*time.Hour, "")
+	assert.Nil(t, err)
+	parsed, err := url.Parse(res)
+	assert.Nil(t, err)
+	assert.Equal(t, "d111111abcdef8.cloudfront.net", parsed.Host)
+	assert.Equal(t, "/archive/README-1", parsed.Path)
+	query := parsed.Query()
+	assert.Equal(t, "1500007200", query.Get("Expires"))
+	assert.Equal(t, "APKAEXAMPLE", query.Get("Key-Pair-Id"))
+
+	// The signature covers the canned policy for the URL
+	policy := `{"Statement":[{"Resource":"https://d111111abcdef8.` +
+		`cloudfront.net/archive/README-1","Condition":{"DateLessThan":` +
+		`{"AWS:EpochTime":1500007200}}}]}`
+	sig, err := base64.StdEncoding.DecodeString(strings.NewReplacer(
+		"-", "+", "_", "=", "~", "/").Replace(query.Get("Signature")))
+	assert.Nil(t, err)
+	hash := sha1.Sum([]byte(policy))
+	assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, hash[:],
+		sig))
+
+	unsigned, cookies, err := signer.SignCookies("/archive/README-1",
+		2*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, parsed.Scheme+"://"+parsed.Host+parsed.Path, unsigned)
+	assert.Equal(t, 3, len(cookies))
+	assert.Equal(t, "CloudFront-Signature", cookies[1].Name)
+	assert.Equal(t, query.Get("Signature"), cookies[1].Value)
+
+	_, err = NewCloudFrontSigner(CloudFrontConfig{
+		PrivateKeyFile: filepath.Join(os.TempDir(), "missing.pem")})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// TracedStore wraps an object store so that each call made with a context
+// gets a span. Calls without a context pass straight through.
+type TracedStore struct {
+	s3iface.S3API
+}
+
+// Attributes describing an object store call.
+func storeAttrs(bucket *string, key *string) []attribute.KeyValue {
+	res := []attribute.KeyValue{
+		attribute.String("aws.s3.bucket", aws.StringValue(bucket)),
+	}
+	if key != nil {
+		res = append(res, attribute.String("aws.s3.key", *key))
+	}
+	return res
+}
+
+// HeadBucketWithContext traces S3API.HeadBucketWithContext
+func (s TracedStore) HeadBucketWithContext(ctx aws.Context,
+	input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput,
+	error) {
+	ctx, span := StartSpan(ctx, "s3.HeadBucket",
+		storeAttrs(input.Bucket, nil)...)
+	res, err := s.S3API.HeadBucketWithContext(ctx, input, opts...)
+	EndSpan(span, err)
+	return res, err
+}
+
+// HeadObjectWithContext traces S3API.HeadObjectWithContext
+func (s TracedStore) HeadObjectWithContext(ctx aws.Context,
+	input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput,
+	error) {
+	ctx, span := StartSpan(ctx, "s3.HeadObject",
+		storeAttrs(input.Bucket, input.Key)...)
+	res, err := s.S3API.HeadObjectWithContext(ctx, input, opts...)
+	EndSpan(span, err)
+	return res, err
+}
+
+// GetObjectWithContext traces S3API.GetObjectWithContext. The span covers
+// the request until the response headers arrive, not reading the body.
+func (s TracedStore) GetObjectWithContext(ctx aws.Context,
+	input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput,
+	error) {
+	ctx, span := StartSpan(ctx, "s3.GetObject",
+		storeAttrs(input.Bucket, input.Key)...)
+	res, err := s.S3API.GetObjectWithContext(ctx, input, opts...)
+	EndSpan(span, err)
+	return res, err
+}
+
+// ListObjectsV2PagesWithContext traces S3API.ListObjectsV2PagesWithContext
+// as one span for all pages
+func (s TracedStore) ListObjectsV2PagesWithContext(ctx aws.Context,
+	input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool,
+	opts ...request.Option) error {
+	ctx, span := StartSpan(ctx, "s3.ListObjectsV2",
+		storeAttrs(input.Bucket, nil)...)
+	err := s.S3API.ListObjectsV2PagesWithContext(ctx, input, fn, opts...)
+	EndSpan(span, err)
+	return err
+}
+
+// DeleteObjectWithContext traces S3API.DeleteObjectWithContext
+func (s TracedStore) DeleteObjectWithContext(ctx aws.Context,
+	input *s3.DeleteObjectInput, opts ...request.Option) (
+	*s3.DeleteObjectOutput, error) {
+	ctx, span := StartSpan(ctx, "s3.DeleteObject",
+		storeAttrs(input.Bucket, input.Key)...)
+	res, err := s.S3API.DeleteObjectWithContext(ctx, input, opts...)
+	EndSpan(span, err)
+	return res, err
+}
+
+// RestoreObjectWithContext traces S3API.RestoreObjectWithContext
+func (s TracedStore) RestoreObjectWithContext(ctx aws.Context,
+	input *s3.RestoreObjectInput, opts ...request.Option) (
+	*s3.RestoreObjectOutput, error) {
+	ctx, span := StartSpan(ctx, "s3.RestoreObject",
+		storeAttrs(input.Bucket, input.Key)...)
+	res, err := s.S3API.RestoreObjectWithContext(ctx, input, opts...)
+	EndSpan(span, err)
+	return res, err
+}
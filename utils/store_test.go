@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type mockStore struct {
+	s3iface.S3API
+}
+
+func (m mockStore) HeadBucketWithContext(aws.Context, *s3.HeadBucketInput,
+	...request.Option) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m mockStore) RestoreObjectWithContext(aws.Context,
+	*s3.RestoreObjectInput, ...request.Option) (*s3.RestoreObjectOutput,
+	error) {
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func TestTracedStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	shutdown, err := SetupTracing(TracingConfig{Exporter: "stdout",
+		SampleRatio: 1, ServiceName: "test"}, buf)
+	assert.Nil(t, err)
+	store := TracedStore{S3API: mockStore{}}
+	_, err = store.HeadBucketWithContext(context.Background(),
+		&s3.HeadBucketInput{Bucket: aws.String("ncbi")})
+	assert.Nil(t, err)
+	_, err = store.RestoreObjectWithContext(context.Background(),
+		&s3.RestoreObjectInput{Bucket: aws.String("ncbi"),
+			Key: aws.String("archive/README-1")})
+	assert.Nil(t, err)
+	assert.Nil(t, shutdown(context.Background()))
+	assert.Contains(t, buf.String(), `"Name":"s3.HeadBucket"`)
+	assert.Contains(t, buf.String(), `"Value":"ncbi"`)
+	assert.Contains(t, buf.String(), `"Name":"s3.RestoreObject"`)
+	assert.Contains(t, buf.String(), `"Value":"archive/README-1"`)
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"strings"
+	"time"
+)
+
+// TimeLayout is the format of points in time passed to the models and
+// compared against DateModified in the Db
+const TimeLayout = "2006-01-02T15:04:05"
+
+// Layouts accepted for a point in time given by a client. A date alone
+// means the start of that day.
+var pointInTimeLayouts = []string{TimeLayout, "2006-01-02T15:04",
+	"2006-01-02"}
+
+// ParsePointInTime parses a point in time like "2017-06-01",
+// "2017-06-01T12:00:00" or "latest" into TimeLayout form
+func ParsePointInTime(value string) (string, error) {
+	if value == "latest" {
+		return time.Now().UTC().Format(TimeLayout), nil
+	}
+	for _, layout := range pointInTimeLayouts {
+		if res, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return res.Format(TimeLayout), nil
+		}
+	}
+	return "", InvalidArgument("invalid_time", "Invalid time "+value+
+		". Use a date like 2017-06-01, a time like 2017-06-01T12:00:00 "+
+		"or latest.", nil)
+}
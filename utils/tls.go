@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the cert and key files are checked for
+// changes
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves a TLS certificate from files on disk and reloads it
+// when either file changes.
+type CertReloader struct {
+	certFile  string
+	keyFile   string
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	log       *slog.Logger
+}
+
+// NewCertReloader loads the certificate and key pair from the given files.
+// Reloads are logged to log.
+func NewCertReloader(certFile string, keyFile string,
+	log *slog.Logger) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if
+// the files have changed. Suitable for tls.Config.GetCertificate.
+func (cr *CertReloader) GetCertificate(
+	*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.lastCheck) >= certCheckInterval {
+		cr.lastCheck = time.Now()
+		if cr.latestModTime().After(cr.modTime) {
+			if err := cr.loadLocked(); err != nil {
+				// Keep serving the old certificate
+				cr.log.Error("Couldn't reload TLS certificate.",
+					"error", err)
+			} else {
+				cr.log.Info("Reloaded TLS certificate.")
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// Loads the certificate and key pair from disk.
+func (cr *CertReloader) load() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.loadLocked()
+}
+
+func (cr *CertReloader) loadLocked() error {
+	modTime := cr.latestModTime()
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return NewErr("Couldn't load key pair.", err)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.lastCheck = time.Now()
+	return nil
+}
+
+// Gets the most recent modification time of the cert and key files.
+func (cr *CertReloader) latestModTime() time.Time {
+	res := time.Time{}
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(res) {
+			res = info.ModTime()
+		}
+	}
+	return res
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+)
+
+// tracerName identifies spans created by this server
+const tracerName = "ncbi-tool-server"
+
+// SetupTracing installs the global tracer provider and W3C trace-context
+// propagation. Spans go to stdout, to an OTLP/HTTP collector, or nowhere,
+// depending on the configured exporter. The returned function flushes and
+// stops the exporter.
+func SetupTracing(conf TracingConfig, out io.Writer) (
+	func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	if conf.Exporter == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(conf.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	}
+	if err != nil {
+		return nil, NewErr("Couldn't create trace exporter.", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(conf.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span as a child of any span in ctx
+func StartSpan(ctx context.Context, name string,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithAttributes(attrs...))
+}
+
+// EndSpan records err on the span, if any, and ends it. Errors that are
+// the client's doing, like asking for a missing file, aren't recorded.
+func EndSpan(span trace.Span, err error) {
+	kind := KindOf(err)
+	if err != nil && kind != KindNotFound && kind != KindInvalidArgument {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -8,9 +8,10 @@ import (
 )
 
 // NewErr combines a custom comment and error into a new formatted error.
+// The error stays in the chain, so its kind is kept.
 func NewErr(input string, err error) error {
 	if err != nil {
-		return errors.New(input + " " + err.Error())
+		return fmt.Errorf("%s %w", input, err)
 	}
 	return errors.New(input)
 }
@@ -18,12 +19,9 @@ func NewErr(input string, err error) error {
 // ComboErr combines a custom comment and two error messages into one
 // formatted error.
 func ComboErr(input string, first error, second error) error {
-	var res string
 	switch {
 	case first != nil && second != nil:
-		res = fmt.Sprintf("%s %s. %s", input, first.Error(),
-			second.Error())
-		return errors.New(res)
+		return fmt.Errorf("%s %w. %w", input, first, second)
 	case first != nil:
 		return NewErr(input, first)
 	case second != nil: